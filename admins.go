@@ -0,0 +1,79 @@
+package relay29
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// isAdminRole uses IsAdminRole if it is set, otherwise any role is administrative.
+func (s *State) isAdminRole(group nip29.Group, role *nip29.Role) bool {
+	if role == nil {
+		return false
+	}
+	if s.IsAdminRole != nil {
+		return s.IsAdminRole(group, role)
+	}
+	return true
+}
+
+// adminRoleNames returns the names of the roles of a member if at least one of them is administrative, otherwise nil.
+// it must be called with the group lock held (for reading, at least).
+func (group *Group) adminRoleNames(pubkey string) []string {
+	roles := group.Members[pubkey]
+	if !slices.ContainsFunc(roles, func(role *nip29.Role) bool { return group.isAdminRole(group.Group, role) }) {
+		return nil
+	}
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if role != nil {
+			names = append(names, role.Name)
+		}
+	}
+	return names
+}
+
+// ToAdminsEvent lists only the members that have administrative roles. it must be called with the group lock held
+// (for reading, at least).
+func (group *Group) ToAdminsEvent() *nostr.Event {
+	evt := &nostr.Event{
+		Kind:      nostr.KindSimpleGroupAdmins,
+		CreatedAt: group.LastAdminsUpdate,
+		Tags:      nostr.Tags{{"d", group.Address.ID}},
+	}
+
+	for pubkey := range group.Members {
+		if names := group.adminRoleNames(pubkey); names != nil {
+			evt.Tags = append(evt.Tags, append(nostr.Tag{"p", pubkey}, names...))
+		}
+	}
+
+	group.addVersionTags(evt)
+	return evt
+}
+
+// hasOneOfTheseAdmins must be called with the group lock held (for reading, at least).
+func (group *Group) hasOneOfTheseAdmins(pubkeys []string) bool {
+	for _, pubkey := range pubkeys {
+		if group.adminRoleNames(pubkey) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// adminsSignature is used to tell if the admins among the given members changed.
+// it must be called with the group lock held (for reading, at least).
+func (group *Group) adminsSignature(pubkeys []string) string {
+	var sig strings.Builder
+	for _, pubkey := range pubkeys {
+		if names := group.adminRoleNames(pubkey); names != nil {
+			sig.WriteString(pubkey)
+			sig.WriteString(strings.Join(names, ","))
+			sig.WriteByte(';')
+		}
+	}
+	return sig.String()
+}
@@ -0,0 +1,71 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingRelay struct {
+	testRelay
+	broadcasted *[]*nostr.Event
+}
+
+func (r recordingRelay) BroadcastEvent(evt *nostr.Event) {
+	*r.broadcasted = append(*r.broadcasted, evt)
+}
+
+func TestAdmins(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	var broadcasted []*nostr.Event
+	state.Relay = recordingRelay{testRelay{state}, &broadcasted}
+	adminsBroadcasted := func() int {
+		n := 0
+		for _, evt := range broadcasted {
+			if evt.Kind == nostr.KindSimpleGroupAdmins {
+				n++
+			}
+		}
+		broadcasted = nil
+		return n
+	}
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	moderator, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	require.NoError(t, state.CreateGroup(ctx, "a", owner, EditMetadata{}))
+	require.Equal(t, 1, adminsBroadcasted())
+
+	// a member without roles isn't an admin
+	require.NoError(t, state.PutUser(ctx, "a", member))
+	require.Equal(t, 0, adminsBroadcasted())
+
+	// one with a role that can moderate is
+	require.NoError(t, state.PutUser(ctx, "a", moderator, "moderator"))
+	require.Equal(t, 1, adminsBroadcasted())
+
+	// putting them again with the same roles doesn't change anything
+	require.NoError(t, state.PutUser(ctx, "a", moderator, "moderator"))
+	require.Equal(t, 0, adminsBroadcasted())
+
+	group, _ := state.Groups.Load("a")
+	admins := group.ToAdminsEvent()
+	require.NotNil(t, admins.Tags.GetFirst([]string{"p", owner, "owner"}))
+	require.NotNil(t, admins.Tags.GetFirst([]string{"p", moderator, "moderator"}))
+	require.Nil(t, admins.Tags.GetFirst([]string{"p", member}))
+	require.True(t, group.hasOneOfTheseAdmins([]string{member, moderator}))
+	require.False(t, group.hasOneOfTheseAdmins([]string{member}))
+
+	// roles can also be classified explicitly
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool { return role.Name == "owner" }
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "a", moderator))
+	require.Equal(t, 0, adminsBroadcasted())
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "a", owner))
+	require.Equal(t, 1, adminsBroadcasted())
+}
@@ -0,0 +1,225 @@
+package relay29
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog/log"
+)
+
+// KindSimpleGroupAuditEntry is the kind of the relay-signed events we generate on the fly from the audit log,
+// these are only ever shown to the admins of the group they refer to
+const KindSimpleGroupAuditEntry = 39100
+
+// AuditEntry records one attempt at performing a moderation action, accepted or not
+type AuditEntry struct {
+	Time     nostr.Timestamp `json:"time"`
+	Group    string          `json:"group"`
+	EventID  string          `json:"event_id"`
+	Actor    string          `json:"actor"`
+	Roles    []string        `json:"roles,omitempty"`
+	Action   string          `json:"action"`
+	Targets  []string        `json:"targets,omitempty"`
+	Accepted bool            `json:"accepted"`
+	Stage    string          `json:"stage,omitempty"`
+	Reason   string          `json:"reason,omitempty"`
+	Adapter  string          `json:"adapter,omitempty"`
+}
+
+func (entry AuditEntry) ToEvent() *nostr.Event {
+	status := "rejected"
+	if entry.Accepted {
+		status = "accepted"
+	}
+
+	actorTag := nostr.Tag{"p", entry.Actor}
+	actorTag = append(actorTag, entry.Roles...)
+
+	evt := &nostr.Event{
+		Kind:      KindSimpleGroupAuditEntry,
+		CreatedAt: entry.Time,
+		Content:   entry.Reason,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", entry.Group},
+			nostr.Tag{"e", entry.EventID},
+			actorTag,
+			nostr.Tag{"action", entry.Action},
+			nostr.Tag{"status", status},
+		},
+	}
+	if entry.Stage != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"stage", entry.Stage})
+	}
+	for _, target := range entry.Targets {
+		evt.Tags = append(evt.Tags, nostr.Tag{"target", target})
+	}
+	if entry.Adapter != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"adapter", entry.Adapter})
+	}
+
+	return evt
+}
+
+// the audit log only lives in memory and is lost on restart (and only the last maxEntries are kept), to keep it
+// around State.AuditLogWriter must be set to something like an append-only file.
+type auditLog struct {
+	mu         sync.RWMutex
+	entries    []AuditEntry
+	maxEntries int
+
+	// many moderation events may be handled at the same time, so lines must be written one at a time
+	writerMu sync.Mutex
+}
+
+// recordRejection takes note of a moderation event from a client that was rejected by a RejectEvent stage (the
+// events we generate ourselves are never half-applied, see applyEvents).
+func (s *State) recordRejection(ctx context.Context, event *nostr.Event, stage string, msg string) {
+	if !IsInternalCall(ctx) {
+		s.recordModerationAttempt(event, false, stage, msg)
+	}
+}
+
+// recordModerationAttempt takes note of a moderation event we've either applied (the first time only, not when
+// groups are rebuilt) or rejected, along with the stage that rejected it. it does nothing for events that aren't
+// moderation events.
+func (s *State) recordModerationAttempt(event *nostr.Event, accepted bool, stage string, reason string) {
+	if !ModerationEventKinds.Includes(event.Kind) {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:     nostr.Now(),
+		EventID:  event.ID,
+		Actor:    event.PubKey,
+		Accepted: accepted,
+		Stage:    stage,
+		Reason:   reason,
+		Adapter:  s.Adapter,
+	}
+
+	if gtag := event.Tags.GetFirst([]string{"h", ""}); gtag != nil {
+		entry.Group = (*gtag)[1]
+	}
+
+	if action, err := PrepareModerationAction(event); err == nil {
+		entry.Action = action.Name()
+	} else {
+		entry.Action = fmt.Sprintf("kind-%d", event.Kind)
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && (tag[0] == "p" || tag[0] == "e") {
+			entry.Targets = append(entry.Targets, tag[1])
+		}
+	}
+
+	if group, _ := s.Groups.Load(entry.Group); group != nil {
+		group.mu.RLock()
+		for _, role := range group.Members[event.PubKey] {
+			if role != nil {
+				entry.Roles = append(entry.Roles, role.Name)
+			}
+		}
+		group.mu.RUnlock()
+	}
+
+	s.audit.mu.Lock()
+	s.audit.entries = append(s.audit.entries, entry)
+	if len(s.audit.entries) > s.audit.maxEntries {
+		s.audit.entries = slices.Delete(s.audit.entries, 0, len(s.audit.entries)-s.audit.maxEntries)
+	}
+	s.audit.mu.Unlock()
+
+	if s.AuditLogWriter != nil {
+		line, _ := json.Marshal(entry)
+		s.audit.writerMu.Lock()
+		_, err := s.AuditLogWriter.Write(append(line, '\n'))
+		s.audit.writerMu.Unlock()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to write to audit log")
+		}
+	}
+}
+
+// AuditEntries returns the audit log entries we have in memory, oldest first, optionally restricted to
+// a given group and to a given actor (empty strings match everything).
+func (s *State) AuditEntries(groupId string, actor string) []AuditEntry {
+	s.audit.mu.RLock()
+	defer s.audit.mu.RUnlock()
+
+	results := make([]AuditEntry, 0, 20)
+	for _, entry := range s.audit.entries {
+		if groupId != "" && entry.Group != groupId {
+			continue
+		}
+		if actor != "" && entry.Actor != actor {
+			continue
+		}
+		results = append(results, entry)
+	}
+	return results
+}
+
+// ExportAuditLog writes all the audit log entries we have in memory as JSONL.
+func (s *State) ExportAuditLog(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, entry := range s.AuditEntries("", "") {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditLogQueryHandler serves the audit log entries of a group as relay-signed events to the admins of that group.
+func (s *State) AuditLogQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event, 1)
+
+	authed := s.GetAuthed(ctx)
+	go func() {
+		defer close(ch)
+
+		if !slices.Contains(filter.Kinds, KindSimpleGroupAuditEntry) || authed == "" {
+			return
+		}
+
+		for _, groupId := range filter.Tags["h"] {
+			group, _ := s.Groups.Load(groupId)
+			if group == nil {
+				continue
+			}
+
+			if authed != s.publicKey {
+				// only admins can see what happened
+				group.mu.RLock()
+				admin := group.adminRoleNames(authed) != nil
+				group.mu.RUnlock()
+				if !admin {
+					continue
+				}
+			}
+
+			for _, entry := range s.AuditEntries(groupId, "") {
+				evt := entry.ToEvent()
+				evt.PubKey = s.publicKey
+				evt.ID = evt.GetID()
+				if !filter.Matches(evt) {
+					continue
+				}
+				evt.Sign(s.secretKey)
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,73 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	member := nostr.GeneratePrivateKey()
+	memberPk, _ := nostr.GetPublicKey(member)
+
+	publish := func(signer string, evt *nostr.Event) (bool, string) {
+		evt.CreatedAt = nostr.Now()
+		evt.Sign(signer)
+		if reject, msg := state.Pipeline.Reject(ctx, evt); reject {
+			return reject, msg
+		}
+		require.NoError(t, state.Pipeline.Store(ctx, evt))
+		state.Pipeline.AfterSave(ctx, evt)
+		return false, ""
+	}
+
+	create := &nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "a"}}}
+	reject, msg := publish(owner, create)
+	require.False(t, reject, msg)
+	reject, msg = publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "a"}, {"p", memberPk}}})
+	require.False(t, reject, msg)
+
+	// rejections are taken note of along with the stage that rejected them
+	reject, _ = publish(member, &nostr.Event{Kind: nostr.KindSimpleGroupRemoveUser, Tags: nostr.Tags{{"h", "a"}, {"p", ownerPk}}})
+	require.True(t, reject)
+	reject, _ = publish(member, &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "nowhere"}, {"p", memberPk}}})
+	require.True(t, reject)
+
+	entries := state.AuditEntries("a", "")
+	require.Len(t, entries, 3)
+	require.True(t, entries[0].Accepted)
+	require.Equal(t, "create-group", entries[0].Action)
+	require.True(t, entries[1].Accepted)
+	require.False(t, entries[2].Accepted)
+	require.Equal(t, "RestrictInvalidModerationActions", entries[2].Stage)
+	require.Equal(t, "RequireHTagForExistingGroup", state.AuditEntries("nowhere", "")[0].Stage)
+
+	// rebuilding the group doesn't make it look like everything happened again
+	state.moderationMu.Lock()
+	state.resyncGroup(ctx, "a")
+	state.moderationMu.Unlock()
+	state.ReloadGroup(ctx, "a")
+	require.Len(t, state.AuditEntries("a", ""), 3)
+
+	// only admins can see it
+	query := func(authed string) int {
+		state.GetAuthed = func(context.Context) string { return authed }
+		ch, err := state.AuditLogQueryHandler(ctx, nostr.Filter{Kinds: []int{KindSimpleGroupAuditEntry}, Tags: nostr.TagMap{"h": []string{"a"}}})
+		require.NoError(t, err)
+		count := 0
+		for range ch {
+			count++
+		}
+		return count
+	}
+	require.Equal(t, 3, query(ownerPk))
+	require.Equal(t, 0, query(memberPk))
+	require.Equal(t, 0, query(""))
+}
@@ -0,0 +1,446 @@
+package relay29
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/rs/zerolog/log"
+)
+
+// many relay processes can run on the same database and accept writes at the same time. the state of each group
+// is always what we get from replaying its moderation events from the database (see sequence.go), so all these
+// processes have to do is tell each other about the events they store (through a ChangeBus) and agree on how many
+// moderation events each group has (through a GroupStore). when a process finds out it was behind or that someone
+// else applied a moderation event to the same group at the same time it rebuilds that group from the database.
+
+// GroupStore keeps the sequence (number of moderation events applied) of each group, shared by all processes.
+type GroupStore interface {
+	Sequence(ctx context.Context, groupId string) (int64, error)
+
+	// Advance moves the sequence of a group from one number to another, it returns false if the sequence wasn't
+	// the expected one (i.e. someone else changed the group before).
+	Advance(ctx context.Context, groupId string, from int64, to int64) (bool, error)
+}
+
+// ChangeBus carries the events stored by each process to all the others.
+type ChangeBus interface {
+	Publish(ctx context.Context, change Change) error
+
+	// Subscribe gets all the changes published from now on (including ours) until ctx is canceled.
+	Subscribe(ctx context.Context) (chan Change, error)
+}
+
+type Change struct {
+	// Origin identifies the process that stored the event
+	Origin string       `json:"origin"`
+	Event  *nostr.Event `json:"event"`
+
+	// Sequence is the sequence of the group after this event, when it's a moderation event
+	Sequence int64 `json:"sequence,omitempty"`
+}
+
+func randomInstanceId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// PublishChange is meant to be called after events are saved.
+func (s *State) PublishChange(ctx context.Context, event *nostr.Event) {
+	if s.changeBus == nil {
+		return
+	}
+	change := Change{Origin: s.instance, Event: event}
+	if ModerationEventKinds.Includes(event.Kind) {
+		change.Sequence = s.sequenceOf(ctx, event)
+	}
+	if err := s.changeBus.Publish(ctx, change); err != nil {
+		// the others will only see it when they catch up with this group
+		log.Error().Err(err).Stringer("event", event).Msg("failed to publish change")
+	}
+}
+
+// sequenceOf tells the sequence of a group right after a moderation event was applied, or 0 if we don't know
+// anymore.
+func (s *State) sequenceOf(ctx context.Context, event *nostr.Event) int64 {
+	// we put this on all the events we generate (see stampSequence) and don't accept it from anyone else
+	if tag := event.Tags.GetFirst([]string{"sequence", ""}); tag != nil && (event.PubKey == s.publicKey || IsInternalCall(ctx)) {
+		sequence, _ := strconv.ParseInt((*tag)[1], 10, 64)
+		return sequence
+	}
+
+	group := s.GetGroupFromEvent(event)
+	if group == nil {
+		return 0
+	}
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+	if group.lastModeration != event.ID {
+		// something else was applied after it
+		return 0
+	}
+	return group.sequence
+}
+
+// claimSequence tells the GroupStore about the moderation events we've just applied to a group. if someone else
+// had changed the group in the meantime the group is rebuilt and true is returned. it must be called with
+// moderationMu held.
+func (s *State) claimSequence(ctx context.Context, groupId string, from int64, to int64) (conflict bool) {
+	if s.groupStore == nil {
+		return false
+	}
+	ok, err := s.groupStore.Advance(ctx, groupId, from, to)
+	if err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to advance group sequence")
+		return false
+	}
+	if !ok {
+		s.resyncGroup(ctx, groupId)
+		return true
+	}
+	return false
+}
+
+// catchUp rebuilds a group if other processes have applied moderation events to it that we haven't seen yet.
+func (s *State) catchUp(ctx context.Context, groupId string) {
+	if s.groupStore == nil {
+		return
+	}
+	shared, err := s.groupStore.Sequence(ctx, groupId)
+	if err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to get group sequence")
+		return
+	}
+
+	var local int64
+	if group, _ := s.Groups.Load(groupId); group != nil {
+		local = group.Sequence()
+	}
+	if shared > local {
+		s.moderationMu.Lock()
+		s.resyncGroup(ctx, groupId)
+		s.moderationMu.Unlock()
+	}
+}
+
+// ReloadGroup throws away what we have in memory for a group and rebuilds it from the database, for when moderation
+// events were applied but may not have been stored. pending are the events that were applied after those and that
+// are still expected to be stored, the ones that belong to this group are applied again on top of the database.
+func (s *State) ReloadGroup(ctx context.Context, groupId string, pending ...*nostr.Event) {
+	s.moderationMu.Lock()
+	defer s.moderationMu.Unlock()
+	s.resyncGroup(ctx, groupId)
+
+	ids := make([]string, 0, len(pending))
+	for _, event := range pending {
+		if ModerationEventKinds.Includes(event.Kind) && GetGroupIDFromEvent(event) == groupId {
+			ids = append(ids, event.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	stored := make(map[string]bool, len(ids))
+	if res, err := s.DB.QueryEvents(ctx, nostr.Filter{IDs: ids}); err == nil {
+		for evt := range res {
+			stored[evt.ID] = true
+		}
+	}
+
+	for _, event := range pending {
+		if !slices.Contains(ids, event.ID) {
+			continue
+		}
+		if stored[event.ID] {
+			// it was stored in the meantime so we have it already
+			continue
+		}
+		if !s.canApply(event) {
+			continue
+		}
+
+		action, err := s.prepareModerationAction(event)
+		if err != nil {
+			continue
+		}
+		if event.Kind == KindSimpleGroupRevert {
+			_, revert, err := s.prepareRevert(ctx, event)
+			if err != nil {
+				log.Warn().Err(err).Stringer("event", event).Msg("failed to prepare revert")
+				continue
+			}
+			action = revert
+		}
+
+		// the ones we generated keep their numbers, the others get new ones after what is in the database
+		sequence := sequenceTag(event, s.publicKey)
+		if sequence == 0 {
+			var ok bool
+			if sequence, ok = s.nextSequence(ctx, event); !ok {
+				continue
+			}
+			group, kinds := s.applyModerationAction(ctx, event, action, sequence)
+			s.broadcastMetadata(group, kinds...)
+			continue
+		}
+
+		group, kinds := s.applyModerationAction(ctx, event, action, sequence)
+		if s.claimSequence(ctx, groupId, group.sequence-1, group.sequence) {
+			return
+		}
+		s.broadcastMetadata(group, kinds...)
+	}
+}
+
+// resyncGroup rebuilds a group from the moderation events in the database and broadcasts its metadata. it must be
+// called with moderationMu held.
+func (s *State) resyncGroup(ctx context.Context, groupId string) {
+	events, sequence, err := s.moderationHistory(ctx, groupId)
+	if err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to load moderation history for resync")
+		return
+	}
+	if len(events) == 0 {
+		// it was never created as far as the database knows
+		if group, _ := s.Groups.LoadAndDelete(groupId); group != nil {
+			group.mu.Lock()
+			touched := slices.Collect(maps.Keys(group.Members))
+			group.Members = map[string][]*nip29.Role{}
+			s.updateMemberships(group, touched)
+			group.mu.Unlock()
+		}
+		return
+	}
+	fresh, err := s.groupFromHistory(groupId, events[0].PubKey, events, sequence)
+	if err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to rebuild group")
+		return
+	}
+	deleted := events[len(events)-1].Kind == nostr.KindSimpleGroupDeleteGroup
+
+	group, _ := s.Groups.Load(groupId)
+	if group == nil {
+		if deleted {
+			return
+		}
+		s.updateMemberships(fresh, slices.Collect(maps.Keys(fresh.Members)))
+		s.Groups.Store(groupId, fresh)
+		group = fresh
+	} else {
+		// we keep the same object since it may be referenced elsewhere
+		group.mu.Lock()
+		touched := slices.Collect(maps.Keys(group.Members))
+		if deleted {
+			fresh.Members = map[string][]*nip29.Role{}
+		} else {
+			for pubkey := range fresh.Members {
+				touched = append(touched, pubkey)
+			}
+		}
+		group.Group = fresh.Group
+		group.Topics = fresh.Topics
+		group.Language = fresh.Language
+		group.createdAt = fresh.createdAt
+		group.sequence = fresh.sequence
+		group.lastModeration = fresh.lastModeration
+		group.membershipChanges = nil
+		group.membershipChangesFrom = fresh.sequence
+		group.membersBroadcasted.Store(fresh.sequence)
+		group.invalidateCaches()
+		s.updateMemberships(group, touched)
+		group.mu.Unlock()
+
+		if deleted {
+			s.Groups.Delete(groupId)
+			return
+		}
+	}
+
+	// we may have been the ones who were behind
+	if s.groupStore != nil {
+		if shared, err := s.groupStore.Sequence(ctx, groupId); err == nil && shared < group.sequence {
+			s.groupStore.Advance(ctx, groupId, shared, group.sequence)
+		}
+	}
+
+	s.broadcastMetadata(group, nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins,
+		nostr.KindSimpleGroupMembers, nostr.KindSimpleGroupRoles)
+}
+
+// listenForChanges applies the events stored by other processes to our in-memory state.
+func (s *State) listenForChanges(ctx context.Context, changes chan Change) {
+	for change := range changes {
+		if change.Origin == s.instance || change.Event == nil {
+			continue
+		}
+		event := change.Event
+
+		if ModerationEventKinds.Includes(event.Kind) {
+			s.applyChange(ctx, event, change.Sequence)
+		}
+		s.AddToPreviousChecking(ctx, event)
+		s.ScheduleExpiration(ctx, event)
+		s.IndexForSearch(ctx, event)
+		s.AddToNegentropyIndex(ctx, event)
+		s.Relay.BroadcastEvent(event)
+	}
+}
+
+// applyChange applies a moderation event another process has stored and applied.
+func (s *State) applyChange(ctx context.Context, event *nostr.Event, sequence int64) {
+	s.moderationMu.Lock()
+	defer s.moderationMu.Unlock()
+
+	group := s.GetGroupFromEvent(event)
+	if group != nil && group.lastModeration == event.ID {
+		// we have this already
+		return
+	}
+	if (group == nil && event.Kind != nostr.KindSimpleGroupCreateGroup) ||
+		sequence == 0 || (group != nil && sequence != group.sequence+1) {
+		// this came out of order or we missed something, so it's easier to start over
+		s.resyncGroup(ctx, GetGroupIDFromEvent(event))
+		return
+	}
+
+	action, err := s.prepareModerationAction(event)
+	if err != nil {
+		return
+	}
+	if event.Kind == KindSimpleGroupRevert {
+		_, revert, err := s.prepareRevert(ctx, event)
+		if err != nil {
+			s.resyncGroup(ctx, GetGroupIDFromEvent(event))
+			return
+		}
+		action = revert
+	}
+
+	// the events were already deleted from the database, but they may still be in our indexes
+	if event.Kind == nostr.KindSimpleGroupDeleteEvent {
+		for _, tag := range event.Tags {
+			if tag.Key() == "e" && nostr.IsValid32ByteHex(tag.Value()) {
+				s.deletedCache.Add(tag.Value())
+				if s.SearchIndex != nil {
+					s.SearchIndex.Remove(ctx, tag.Value())
+				}
+			}
+		}
+		if group != nil {
+			group.negentropy.reset()
+		}
+	}
+
+	group, kinds := s.applyModerationAction(ctx, event, action, sequence)
+	s.broadcastMetadata(group, kinds...)
+}
+
+// MemoryGroupStore is a GroupStore for processes that run in the same process, mostly useful for testing.
+type MemoryGroupStore struct {
+	mu        sync.Mutex
+	sequences map[string]int64
+}
+
+var _ GroupStore = (*MemoryGroupStore)(nil)
+
+func NewMemoryGroupStore() *MemoryGroupStore {
+	return &MemoryGroupStore{sequences: make(map[string]int64)}
+}
+
+func (ms *MemoryGroupStore) Sequence(ctx context.Context, groupId string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.sequences[groupId], nil
+}
+
+func (ms *MemoryGroupStore) Advance(ctx context.Context, groupId string, from int64, to int64) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.sequences[groupId] != from {
+		return false, nil
+	}
+	ms.sequences[groupId] = to
+	return true, nil
+}
+
+// MemoryChangeBus is a ChangeBus for States that run in the same process, mostly useful for testing.
+type MemoryChangeBus struct {
+	mu          sync.Mutex
+	subscribers map[*changeQueue]struct{}
+}
+
+var _ ChangeBus = (*MemoryChangeBus)(nil)
+
+func NewMemoryChangeBus() *MemoryChangeBus {
+	return &MemoryChangeBus{subscribers: make(map[*changeQueue]struct{})}
+}
+
+// publishing never blocks, so each subscriber gets a queue
+type changeQueue struct {
+	mu      sync.Mutex
+	pending []Change
+	wake    chan struct{}
+}
+
+func (mb *MemoryChangeBus) Publish(ctx context.Context, change Change) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for queue := range mb.subscribers {
+		queue.mu.Lock()
+		queue.pending = append(queue.pending, change)
+		queue.mu.Unlock()
+		select {
+		case queue.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (mb *MemoryChangeBus) Subscribe(ctx context.Context) (chan Change, error) {
+	queue := &changeQueue{wake: make(chan struct{}, 1)}
+	mb.mu.Lock()
+	mb.subscribers[queue] = struct{}{}
+	mb.mu.Unlock()
+
+	ch := make(chan Change)
+	go func() {
+		defer close(ch)
+		defer func() {
+			mb.mu.Lock()
+			delete(mb.subscribers, queue)
+			mb.mu.Unlock()
+		}()
+
+		for {
+			queue.mu.Lock()
+			pending := queue.pending
+			queue.pending = nil
+			queue.mu.Unlock()
+
+			for _, change := range pending {
+				select {
+				case ch <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-queue.wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
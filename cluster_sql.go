@@ -0,0 +1,186 @@
+package relay29
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SQLCluster is a GroupStore and a ChangeBus backed by a SQL database that all processes can reach. it only uses
+// plain SQL with "$n" placeholders, so it should work with postgres and sqlite (bring your own driver).
+type SQLCluster struct {
+	DB *sql.DB
+
+	// PollInterval is how often we look for new changes (defaults to 100ms)
+	PollInterval time.Duration
+
+	// KeepChanges is how many changes we keep in the table for processes that are a little behind (defaults to 10000)
+	KeepChanges int64
+}
+
+// how long we keep trying to publish a change
+const publishTimeout = time.Second * 10
+
+var (
+	_ GroupStore = (*SQLCluster)(nil)
+	_ ChangeBus  = (*SQLCluster)(nil)
+)
+
+func NewSQLCluster(db *sql.DB) (*SQLCluster, error) {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS relay29_sequences (group_id TEXT PRIMARY KEY, sequence BIGINT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS relay29_changes (id BIGINT PRIMARY KEY, origin TEXT NOT NULL, data TEXT NOT NULL)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to create tables: %w", err)
+		}
+	}
+	return &SQLCluster{DB: db, PollInterval: time.Millisecond * 100, KeepChanges: 10000}, nil
+}
+
+func (sc *SQLCluster) Sequence(ctx context.Context, groupId string) (int64, error) {
+	var sequence int64
+	err := sc.DB.QueryRowContext(ctx, `SELECT sequence FROM relay29_sequences WHERE group_id = $1`, groupId).
+		Scan(&sequence)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return sequence, err
+}
+
+func (sc *SQLCluster) Advance(ctx context.Context, groupId string, from int64, to int64) (bool, error) {
+	res, err := sc.DB.ExecContext(ctx,
+		`UPDATE relay29_sequences SET sequence = $1 WHERE group_id = $2 AND sequence = $3`, to, groupId, from)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, nil
+	}
+
+	if from == 0 {
+		// a new group
+		if _, err := sc.DB.ExecContext(ctx,
+			`INSERT INTO relay29_sequences (group_id, sequence) VALUES ($1, $2)`, groupId, to); err == nil {
+			return true, nil
+		}
+		// someone else inserted it first (or something else is wrong, which we'll find out here)
+		if _, err := sc.Sequence(ctx, groupId); err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+func (sc *SQLCluster) Publish(ctx context.Context, change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	// the ids must be sequential, so if two processes pick the same one at the same time one of them tries again
+	// (and again, for as long as it takes, there may be many processes doing this)
+	deadline := time.Now().Add(publishTimeout)
+	wait := time.Millisecond
+	for {
+		_, err = sc.DB.ExecContext(ctx,
+			`INSERT INTO relay29_changes (id, origin, data)
+			 SELECT COALESCE(MAX(id), 0) + 1, $1, $2 FROM relay29_changes`, change.Origin, string(data))
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up publishing change: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait + time.Duration(mathrand.Int64N(int64(wait)))):
+			wait = min(wait*2, time.Millisecond*100)
+		}
+	}
+}
+
+func (sc *SQLCluster) Subscribe(ctx context.Context) (chan Change, error) {
+	var last int64
+	if err := sc.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM relay29_changes`).Scan(&last); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Change)
+	go func() {
+		defer close(ch)
+		cleaned := last
+		ticker := time.NewTicker(sc.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			changes, upTo, err := sc.changesAfter(ctx, last)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to poll for changes")
+				continue
+			}
+			for _, change := range changes {
+				select {
+				case ch <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+			last = upTo
+
+			// we do the cleanup every once in a while
+			if last-cleaned >= 1000 && last > sc.KeepChanges {
+				cleaned = last
+				if _, err := sc.DB.ExecContext(ctx,
+					`DELETE FROM relay29_changes WHERE id <= $1`, last-sc.KeepChanges); err != nil {
+					log.Warn().Err(err).Msg("failed to delete old changes")
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// changesAfter gets the changes after the given id and the id of the last one it looked at.
+func (sc *SQLCluster) changesAfter(ctx context.Context, last int64) ([]Change, int64, error) {
+	rows, err := sc.DB.QueryContext(ctx,
+		`SELECT id, data FROM relay29_changes WHERE id > $1 ORDER BY id LIMIT 500`, last)
+	if err != nil {
+		return nil, last, err
+	}
+	defer rows.Close()
+
+	changes := make([]Change, 0, 10)
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, last, err
+		}
+		last = id
+
+		var change Change
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			log.Warn().Err(err).Int64("id", id).Msg("skipping broken change")
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, last, rows.Err()
+}
@@ -0,0 +1,85 @@
+package relay29
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLCluster(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "cluster.db")+"?_busy_timeout=5000")
+	require.NoError(t, err)
+	defer sqlDB.Close()
+	cluster, err := NewSQLCluster(sqlDB)
+	require.NoError(t, err)
+	cluster.PollInterval = time.Millisecond * 10
+
+	// sequences only move from where they are
+	ok, err := cluster.Advance(ctx, "s", 0, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = cluster.Advance(ctx, "s", 0, 1)
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = cluster.Advance(ctx, "s", 1, 3)
+	require.NoError(t, err)
+	require.True(t, ok)
+	sequence, err := cluster.Sequence(ctx, "s")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), sequence)
+	sequence, err = cluster.Sequence(ctx, "nothing")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sequence)
+
+	// two processes sharing the same database and the same cluster
+	db := &MemoryStore{}
+	db.Init()
+	secretKey := nostr.GeneratePrivateKey()
+	owner := &nip29.Role{Name: "owner"}
+	start := func() *State {
+		state := New(Options{
+			Domain:                  "localhost",
+			DB:                      db,
+			SecretKey:               secretKey,
+			DefaultRoles:            []*nip29.Role{owner},
+			GroupCreatorDefaultRole: owner,
+			GroupStore:              cluster,
+			ChangeBus:               cluster,
+		})
+		state.GetAuthed = func(context.Context) string { return "" }
+		state.AllowAction = func(ctx context.Context, group nip29.Group, role *nip29.Role, action Action) bool {
+			return role == owner
+		}
+		state.Relay = testRelay{state}
+		return state
+	}
+	a := start()
+	defer a.Close()
+	b := start()
+	defer b.Close()
+
+	creatorPk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	isMember := func(state *State, pubkey string) func() bool {
+		return func() bool { return len(state.Memberships(pubkey)) > 0 }
+	}
+
+	require.NoError(t, a.CreateGroup(ctx, "g", creatorPk, EditMetadata{}))
+	require.Eventually(t, isMember(b, creatorPk), time.Second*2, time.Millisecond*10)
+	require.NoError(t, b.PutUser(ctx, "g", member))
+	require.Eventually(t, isMember(a, member), time.Second*2, time.Millisecond*10)
+
+	group, _ := a.Groups.Load("g")
+	sequence, err = cluster.Sequence(ctx, "g")
+	require.NoError(t, err)
+	require.Equal(t, group.Sequence(), sequence)
+}
@@ -0,0 +1,167 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+
+	db := &MemoryStore{}
+	db.Init()
+	store := NewMemoryGroupStore()
+	bus := NewMemoryChangeBus()
+	secretKey := nostr.GeneratePrivateKey()
+	owner := &nip29.Role{Name: "owner"}
+
+	// two processes sharing the same database
+	start := func() *State {
+		state := New(Options{
+			Domain:                  "localhost",
+			DB:                      db,
+			SecretKey:               secretKey,
+			DefaultRoles:            []*nip29.Role{owner},
+			GroupCreatorDefaultRole: owner,
+			GroupStore:              store,
+			ChangeBus:               bus,
+		})
+		state.GetAuthed = func(context.Context) string { return "" }
+		state.AllowAction = func(ctx context.Context, group nip29.Group, role *nip29.Role, action Action) bool {
+			return role == owner
+		}
+		state.Relay = testRelay{state}
+		return state
+	}
+	a := start()
+	b := start()
+
+	creator := nostr.GeneratePrivateKey()
+	creatorPk, _ := nostr.GetPublicKey(creator)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	isMember := func(state *State, pubkey string) func() bool {
+		return func() bool {
+			group, _ := state.Groups.Load("g")
+			if group == nil {
+				return false
+			}
+			group.mu.RLock()
+			defer group.mu.RUnlock()
+			_, ok := group.Members[pubkey]
+			return ok
+		}
+	}
+
+	// changes made in one are seen by the other
+	require.NoError(t, a.CreateGroup(ctx, "g", creatorPk, EditMetadata{}))
+	require.Eventually(t, isMember(b, creatorPk), time.Second, time.Millisecond*10)
+	require.NoError(t, b.PutUser(ctx, "g", member))
+	require.Eventually(t, isMember(a, member), time.Second, time.Millisecond*10)
+
+	// including the previous-tag buffers
+	msg := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: "hi", Tags: nostr.Tags{{"h", "g"}}}
+	msg.Sign(creator)
+	_, err := b.Relay.AddEvent(ctx, msg)
+	require.NoError(t, err)
+	reply := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: "hello", Tags: nostr.Tags{{"h", "g"}, {"previous", msg.ID[0:8]}}}
+	reply.Sign(creator)
+	require.Eventually(t, func() bool {
+		rejected, _ := a.CheckPreviousTag(ctx, reply)
+		return !rejected
+	}, time.Second, time.Millisecond*10)
+
+	// a process that hasn't heard of a change (here someone wrote to the database without telling anyone) catches up
+	// before accepting new moderation events
+	group, _ := a.Groups.Load("g")
+	sequence := group.Sequence()
+	sneaky := &nostr.Event{
+		CreatedAt: nostr.Now() + 1,
+		Kind:      nostr.KindSimpleGroupPutUser,
+		Tags:      nostr.Tags{{"h", "g"}, {"p", other}},
+	}
+	sneaky.Sign(creator)
+	saveSequenced(t, a, sneaky, sequence+1)
+	ok, _ := store.Advance(ctx, "g", sequence, sequence+1)
+	require.True(t, ok)
+
+	require.False(t, isMember(a, other)())
+	require.NoError(t, a.RemoveUserFromGroup(ctx, "g", member))
+	require.True(t, isMember(a, other)())
+	require.False(t, isMember(a, member)())
+	require.Eventually(t, func() bool { return isMember(b, other)() && !isMember(b, member)() }, time.Second, time.Millisecond*10)
+
+	group, _ = a.Groups.Load("g")
+	seq, _ := store.Sequence(ctx, "g")
+	require.Equal(t, group.Sequence(), seq)
+
+	// each change in a batch says where its own event goes
+	listening, stop := context.WithCancel(ctx)
+	defer stop()
+	changes, err := bus.Subscribe(listening)
+	require.NoError(t, err)
+	name := "h"
+	require.NoError(t, a.CreateGroup(ctx, "h", creatorPk, EditMetadata{NameValue: &name}))
+	for _, expected := range []int64{1, 2} {
+		change := <-changes
+		require.Equal(t, expected, change.Sequence)
+	}
+
+	a.Close()
+	b.Close()
+}
+
+func TestReloadGroup(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	creator := nostr.GeneratePrivateKey()
+	creatorPk, _ := nostr.GetPublicKey(creator)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	require.NoError(t, state.CreateGroup(ctx, "g", creatorPk, EditMetadata{}))
+
+	// moderation events applied without being stored are undone
+	putUser := &nostr.Event{CreatedAt: nostr.Now() + 1, Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", member}}}
+	putUser.Sign(creator)
+	reject, msg := state.Pipeline.Reject(ctx, putUser)
+	require.False(t, reject, msg)
+	state.ApplyModerationAction(ctx, putUser)
+	require.Contains(t, state.Memberships(member), "g")
+
+	state.ReloadGroup(ctx, "g")
+	require.NotContains(t, state.Memberships(member), "g")
+	group, _ := state.Groups.Load("g")
+	require.NotNil(t, group)
+	require.Equal(t, int64(2), group.Sequence()) // the number it got isn't given out again
+
+	// the ones that came after and are still expected to be stored are kept
+	state.ApplyModerationAction(ctx, putUser)
+	other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	putOther := &nostr.Event{CreatedAt: nostr.Now() + 2, Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", other}}}
+	putOther.Sign(creator)
+	state.ApplyModerationAction(ctx, putOther)
+	require.Contains(t, state.Memberships(other), "g")
+
+	state.ReloadGroup(ctx, "g", putOther)
+	require.Contains(t, state.Memberships(other), "g")
+	require.NotContains(t, state.Memberships(member), "g")
+	require.Equal(t, int64(5), group.Sequence())
+
+	// and groups that were never stored go away
+	createGroup := &nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "x"}}}
+	createGroup.Sign(creator)
+	state.ApplyModerationAction(ctx, createGroup)
+	require.Contains(t, state.Memberships(creatorPk), "x")
+
+	state.ReloadGroup(ctx, "x")
+	group, _ = state.Groups.Load("x")
+	require.Nil(t, group)
+	require.NotContains(t, state.Memberships(creatorPk), "x")
+	require.Contains(t, state.Memberships(creatorPk), "g")
+}
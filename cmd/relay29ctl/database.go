@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type database struct {
+	eventstore.Store
+
+	// for dumps, called with the store when we're done if we've written something
+	save func(eventstore.Store) error
+}
+
+func (db database) Finish(written bool) error {
+	defer db.Store.Close()
+	if written && db.save != nil {
+		return db.save(db.Store)
+	}
+	return nil
+}
+
+func openDatabase(kind string, path string) (database, error) {
+	switch kind {
+	case "lmdb":
+		store := &lmdb.LMDBBackend{Path: path}
+		return database{Store: store}, store.Init()
+	case "badger":
+		store := &badger.BadgerBackend{Path: path}
+		return database{Store: store}, store.Init()
+	case "sqlite":
+		// we go through everything a page at a time (see relay29.PageEvents), the default limit is smaller than that
+		store := &sqlite3.SQLite3Backend{DatabaseURL: path, QueryLimit: 1000}
+		return database{Store: store}, store.Init()
+	case "jsonl":
+		// a file with one event per line, like what `strfry export` gives, loaded into memory and written back
+		store := &relay29.MemoryStore{MaxLimit: math.MaxInt}
+		store.Init()
+		if err := loadDump(store, path); err != nil {
+			return database{}, err
+		}
+		return database{Store: store, save: func(store eventstore.Store) error { return saveDump(store, path) }}, nil
+	default:
+		return database{}, fmt.Errorf("unsupported database type '%s'", kind)
+	}
+}
+
+func loadDump(store eventstore.Store, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1<<16), 1<<24)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		evt := &nostr.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), evt); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := store.SaveEvent(context.Background(), evt); err != nil && err != eventstore.ErrDupEvent {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func saveDump(store eventstore.Store, path string) error {
+	ch, err := store.QueryEvents(context.Background(), nostr.Filter{Limit: math.MaxInt})
+	if err != nil {
+		return err
+	}
+
+	// write everything to a new file first so we don't lose the old one if something goes wrong
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for evt := range ch {
+		w.Write([]byte(evt.String()))
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
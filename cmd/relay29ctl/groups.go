@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func loadGroup(state *relay29.State, groupId string) (*relay29.Group, error) {
+	group, _ := state.Groups.Load(groupId)
+	if group == nil {
+		return nil, fmt.Errorf("group '%s' doesn't exist", groupId)
+	}
+	return group, nil
+}
+
+func listGroups(ctx context.Context, state *relay29.State, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tMEMBERS\tFLAGS")
+	ids := make([]string, 0, state.Groups.Size())
+	state.Groups.Range(func(id string, _ *relay29.Group) bool {
+		ids = append(ids, id)
+		return true
+	})
+	slices.Sort(ids)
+	for _, id := range ids {
+		group, _ := state.Groups.Load(id)
+		flags := make([]string, 0, 3)
+		if group.Private {
+			flags = append(flags, "private")
+		}
+		if group.Closed {
+			flags = append(flags, "closed")
+		}
+		if group.MovedTo.Relay != "" {
+			flags = append(flags, "moved to "+group.MovedTo.Relay)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", id, group.Name, len(group.Members), strings.Join(flags, ", "))
+	}
+	return w.Flush()
+}
+
+func listMembers(ctx context.Context, state *relay29.State, args []string) error {
+	group, err := loadGroup(state, args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PUBKEY\tROLES")
+	pubkeys := make([]string, 0, len(group.Members))
+	for pubkey := range group.Members {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	slices.Sort(pubkeys)
+	for _, pubkey := range pubkeys {
+		fmt.Fprintf(w, "%s\t%s\n", pubkey, strings.Join(relay29.RoleNames(group.Members[pubkey]), ", "))
+	}
+	return w.Flush()
+}
+
+func listRoles(ctx context.Context, state *relay29.State, args []string) error {
+	group, err := loadGroup(state, args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tMEMBERS\tDESCRIPTION")
+	for _, role := range group.Roles {
+		count := 0
+		for _, roles := range group.Members {
+			if slices.Contains(roles, role) {
+				count++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", role.Name, count, role.Description)
+	}
+	return w.Flush()
+}
+
+func printHistory(ctx context.Context, state *relay29.State, args []string) error {
+	steps, err := state.ModerationLog(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		fmt.Printf("%s %s %s by %s\n",
+			step.Event.CreatedAt.Time().UTC().Format("2006-01-02 15:04:05"), step.Event.ID, step.Action.Name(), step.Event.PubKey)
+		for _, pubkey := range step.Changes.MembersAdded {
+			fmt.Printf("  + %s\n", pubkey)
+		}
+		for _, pubkey := range step.Changes.MembersRemoved {
+			fmt.Printf("  - %s\n", pubkey)
+		}
+		for pubkey, change := range step.Changes.RolesChanged {
+			fmt.Printf("  ~ %s: [%s] -> [%s]\n", pubkey, strings.Join(change.Before, ", "), strings.Join(change.After, ", "))
+		}
+		for field, change := range step.Changes.MetadataChanged {
+			fmt.Printf("  ~ %s: %q -> %q\n", field, change.Before, change.After)
+		}
+	}
+	return nil
+}
+
+func createGroup(ctx context.Context, state *relay29.State, args []string) error {
+	if !nostr.IsValid32ByteHex(args[1]) {
+		return fmt.Errorf("invalid pubkey '%s'", args[1])
+	}
+	defs := relay29.EditMetadata{}
+	if len(args) > 2 {
+		defs.NameValue = &args[2]
+	}
+	return state.CreateGroup(ctx, args[0], args[1], defs)
+}
+
+func deleteGroup(ctx context.Context, state *relay29.State, args []string) error {
+	if _, err := loadGroup(state, args[0]); err != nil {
+		return err
+	}
+	return state.DeleteGroup(ctx, args[0])
+}
+
+func putUser(ctx context.Context, state *relay29.State, args []string) error {
+	if _, err := loadGroup(state, args[0]); err != nil {
+		return err
+	}
+	if !nostr.IsValid32ByteHex(args[1]) {
+		return fmt.Errorf("invalid pubkey '%s'", args[1])
+	}
+	return state.PutUser(ctx, args[0], args[1], args[2:]...)
+}
+
+func removeUser(ctx context.Context, state *relay29.State, args []string) error {
+	if _, err := loadGroup(state, args[0]); err != nil {
+		return err
+	}
+	if !nostr.IsValid32ByteHex(args[1]) {
+		return fmt.Errorf("invalid pubkey '%s'", args[1])
+	}
+	return state.RemoveUserFromGroup(ctx, args[0], args[1])
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// relay29ctl works directly on the database of a relay29 instance, going through relay29.State just like the relay
+// does, so it must use the same settings as the relay and the relay shouldn't be running at the same time.
+
+type Settings struct {
+	Domain       string   `envconfig:"DOMAIN" required:"true"`
+	RelayPrivkey string   `envconfig:"RELAY_PRIVKEY" required:"true"`
+	DatabaseType string   `envconfig:"DATABASE_TYPE" default:"lmdb"`
+	DatabasePath string   `envconfig:"DATABASE_PATH" default:"./db"`
+	Roles        []string `envconfig:"ROLES" default:"admin,moderator"`
+}
+
+const usage = `usage: relay29ctl <command> [arguments]
+
+  groups                                   list all groups
+  members <group>                          list the members of a group and their roles
+  roles <group>                            list the roles available in a group
+  history <group>                          print the moderation history of a group and what each event changed
+  create <group> <creator-pubkey> [<name>] create a group
+  delete <group>                           delete a group
+  put <group> <pubkey> [<role>...]         add a user to a group or change their roles
+  remove <group> <pubkey>                  remove a user from a group
+  verify                                   check the moderation history of all groups for problems
+  export <group> <new-relay-url> [<new-group-id>] > bundle.json
+                                           move a group to another relay
+  import <old-relay-pubkey> [<new-group-id>] < bundle.json
+                                           recreate a group that was moved here
+
+settings are taken from the environment: DOMAIN, RELAY_PRIVKEY, DATABASE_TYPE (lmdb, badger, sqlite or jsonl), DATABASE_PATH and
+ROLES (comma-separated, the first one is given to group creators).`
+
+type command struct {
+	args   int // minimum number of arguments
+	writes bool
+	run    func(ctx context.Context, state *relay29.State, args []string) error
+}
+
+var commands = map[string]command{
+	"groups":  {0, false, listGroups},
+	"members": {1, false, listMembers},
+	"roles":   {1, false, listRoles},
+	"history": {1, false, printHistory},
+	"create":  {2, true, createGroup},
+	"delete":  {1, true, deleteGroup},
+	"put":     {2, true, putUser},
+	"remove":  {2, true, removeUser},
+	"verify":  {0, false, verify},
+	"export":  {2, true, exportGroup},
+	"import":  {1, true, importGroup},
+}
+
+var s Settings
+
+func main() {
+	if len(os.Args) < 2 {
+		fail(usage)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok || len(os.Args)-2 < cmd.args {
+		fail(usage)
+	}
+	if err := envconfig.Process("", &s); err != nil {
+		fail("couldn't process envconfig: %s", err)
+	}
+
+	db, err := openDatabase(s.DatabaseType, s.DatabasePath)
+	if err != nil {
+		fail("failed to open database: %s", err)
+	}
+
+	roles := make([]*nip29.Role, len(s.Roles))
+	for i, name := range s.Roles {
+		roles[i] = &nip29.Role{Name: strings.TrimSpace(name)}
+	}
+	state := relay29.New(relay29.Options{
+		Domain:                  s.Domain,
+		DB:                      db,
+		SecretKey:               s.RelayPrivkey,
+		DefaultRoles:            roles,
+		GroupCreatorDefaultRole: roles[0],
+		NoBackgroundWork:        true,
+	})
+	state.Relay = offline{}
+	state.GetAuthed = func(context.Context) string { return "" }
+
+	err = cmd.run(context.Background(), state, os.Args[2:])
+	state.Close()
+	if err := db.Finish(cmd.writes); err != nil {
+		fail("failed to close database: %s", err)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+func fail(msg string, args ...any) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	os.Exit(1)
+}
+
+// the relay isn't running here, so there is no one to broadcast to
+type offline struct{}
+
+func (offline) BroadcastEvent(*nostr.Event) {}
+
+func (offline) AddEvent(context.Context, *nostr.Event) (bool, error) {
+	return false, fmt.Errorf("the relay is offline")
+}
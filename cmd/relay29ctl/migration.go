@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func exportGroup(ctx context.Context, state *relay29.State, args []string) error {
+	newGroupId := ""
+	if len(args) > 2 {
+		newGroupId = args[2]
+	}
+	bundle, err := state.ExportGroup(ctx, args[0], args[1], newGroupId)
+	if err != nil {
+		return fmt.Errorf("failed to export: %w", err)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(bundle); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d moderation events and %d other events\n",
+		len(bundle.Moderation), len(bundle.Content))
+	return nil
+}
+
+func importGroup(ctx context.Context, state *relay29.State, args []string) error {
+	if !nostr.IsValid32ByteHex(args[0]) {
+		return fmt.Errorf("invalid pubkey '%s'", args[0])
+	}
+	newGroupId := ""
+	if len(args) > 1 {
+		newGroupId = args[1]
+	}
+	var bundle relay29.MigrationBundle
+	if err := json.NewDecoder(os.Stdin).Decode(&bundle); err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	n, err := state.ImportGroup(ctx, bundle, args[0], newGroupId)
+	if err != nil {
+		return fmt.Errorf("failed to import: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d events\n", n)
+	return nil
+}
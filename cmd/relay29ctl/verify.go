@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// verify goes through the moderation events of all groups (even deleted ones) looking for things that would make
+// the relay load them differently than they were when it was running.
+func verify(ctx context.Context, state *relay29.State, args []string) error {
+	creations := make(map[string]int)
+	moderated := make(map[string]int)
+	err := relay29.PageEvents(ctx, state.DB.QueryEvents, nostr.Filter{Kinds: relay29.ModerationEventKinds}, func(evt *nostr.Event) {
+		gtag := evt.Tags.GetFirst([]string{"h", ""})
+		if gtag == nil {
+			fmt.Printf("event %s: moderation event without a group\n", evt.ID)
+			return
+		}
+		moderated[(*gtag)[1]]++
+		if evt.Kind == nostr.KindSimpleGroupCreateGroup {
+			creations[(*gtag)[1]]++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(moderated))
+	for id := range moderated {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	relayPubKey, _ := nostr.GetPublicKey(s.RelayPrivkey)
+	problems := 0
+	report := func(groupId string, msg string, args ...any) {
+		problems++
+		fmt.Printf("group '%s': %s\n", groupId, fmt.Sprintf(msg, args...))
+	}
+	for _, id := range ids {
+		switch creations[id] {
+		case 0:
+			report(id, "%d moderation events but it was never created", moderated[id])
+			continue
+		case 1:
+		default:
+			report(id, "created %d times", creations[id])
+		}
+
+		steps, err := state.ModerationLog(ctx, id)
+		if err != nil {
+			report(id, "can't replay moderation history: %s", err)
+			continue
+		}
+		if len(steps) != moderated[id] {
+			report(id, "history has %d events, but there are %d in the database", len(steps), moderated[id])
+		}
+		if steps[0].Event.Kind != nostr.KindSimpleGroupCreateGroup {
+			report(id, "history starts with %s, not with the group creation", steps[0].Event.ID)
+		}
+		for i, step := range steps {
+			evt := step.Event
+			if evt.Kind == nostr.KindSimpleGroupDeleteGroup && i != len(steps)-1 {
+				report(id, "%d moderation events after it was deleted by %s", len(steps)-1-i, evt.ID)
+			}
+			switch {
+			case evt.PubKey == relayPubKey:
+				// ours
+			case i == 0 && evt.Kind == nostr.KindSimpleGroupCreateGroup && evt.Sig == "":
+				// the relay creates groups on behalf of their creators without signing (see State.CreateGroup), no
+				// client could have stored an event without a signature
+			default:
+				if ok, _ := evt.CheckSignature(); !ok {
+					report(id, "event %s has an invalid signature", evt.ID)
+				}
+			}
+		}
+
+		_, live := state.Groups.Load(id)
+		deleted := steps[len(steps)-1].Event.Kind == nostr.KindSimpleGroupDeleteGroup
+		if live == deleted {
+			report(id, "loaded=%v but deleted=%v", live, deleted)
+		}
+	}
+
+	fmt.Printf("%d groups checked, %d problems found\n", len(ids), problems)
+	if problems > 0 {
+		return fmt.Errorf("verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package relay29
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog/log"
+)
+
+// the groups we have in memory should always be exactly what we get from replaying their moderation events from
+// the database (which is what happens on restart). CheckConsistency verifies that by loading all the groups again
+// into a scratch State and comparing.
+//
+// when repairing, the live state wins: it's what clients have been seeing all along, so we emit moderation events
+// that make the database agree with it.
+
+// GroupDrift is a difference between a group in memory and the same group rebuilt from the database.
+type GroupDrift struct {
+	Group string `json:"group"`
+
+	// Missing means the group exists in the database but not in memory, Unexpected is the opposite
+	Missing    bool `json:"missing,omitempty"`
+	Unexpected bool `json:"unexpected,omitempty"`
+
+	// Diff goes from what we have in memory to what we would have after a restart
+	Diff GroupDiff `json:"diff"`
+
+	// Truncated means some of the moderation events of the group are gone from the database, so we can't know
+	// what the group really looks like and it isn't repaired
+	Truncated bool `json:"truncated,omitempty"`
+
+	Repaired    bool   `json:"repaired,omitempty"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// CheckConsistency compares all groups in memory with the same groups rebuilt from the database. if repair is
+// true relay-signed moderation events are emitted to fix the differences that can be fixed (everything except
+// missing and unexpected groups and groups with a truncated history).
+func (s *State) CheckConsistency(ctx context.Context, repair bool) ([]GroupDrift, error) {
+	scratch := newState(Options{
+		Domain:                  s.Domain,
+		DB:                      s.DB,
+		SecretKey:               s.secretKey,
+		DefaultRoles:            s.defaultRoles,
+		GroupCreatorDefaultRole: s.groupCreatorDefaultRole,
+	})
+	defer scratch.Close()
+	scratch.AllowAction = s.AllowAction
+	scratch.IsAdminRole = s.IsAdminRole
+	if err := scratch.loadGroupsFromDB(ctx); err != nil {
+		return nil, err
+	}
+
+	// things may change while we load, so whatever looks different is checked again more carefully
+	suspects := make([]string, 0, 10)
+	scratch.Groups.Range(func(id string, fresh *Group) bool {
+		live, _ := s.Groups.Load(id)
+		if live == nil || !live.sameAs(fresh) {
+			suspects = append(suspects, id)
+		}
+		return true
+	})
+	s.Groups.Range(func(id string, _ *Group) bool {
+		if fresh, _ := scratch.Groups.Load(id); fresh == nil {
+			suspects = append(suspects, id)
+		}
+		return true
+	})
+	slices.Sort(suspects)
+
+	drifts := make([]GroupDrift, 0, len(suspects))
+	for _, id := range suspects {
+		if drift, ok := s.checkGroupConsistency(ctx, id, repair); ok {
+			drifts = append(drifts, drift)
+		}
+	}
+
+	return drifts, nil
+}
+
+// checkGroupConsistency rebuilds one group from the database and compares it to what we have in memory (and repairs
+// it if asked to), with no moderation events being applied in the meantime.
+func (s *State) checkGroupConsistency(ctx context.Context, groupId string, repair bool) (drift GroupDrift, found bool) {
+	s.catchUp(ctx, groupId)
+
+	s.moderationMu.Lock()
+	defer s.moderationMu.Unlock()
+
+	drift.Group = groupId
+	var fresh *Group
+	events, sequence, err := s.moderationHistory(ctx, groupId)
+	if err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to load moderation history")
+		return drift, false
+	} else if len(events) > 0 && events[len(events)-1].Kind != nostr.KindSimpleGroupDeleteGroup {
+		fresh, err = s.groupFromHistory(groupId, events[0].PubKey, events, sequence)
+		if err != nil {
+			log.Warn().Err(err).Str("group", groupId).Msg("failed to rebuild group")
+			return drift, false
+		}
+	}
+
+	live, _ := s.Groups.Load(groupId)
+	switch {
+	case live == nil && fresh == nil:
+		return drift, false
+	case live == nil:
+		drift.Missing = true
+		return drift, true
+	case fresh == nil:
+		drift.Unexpected = true
+		return drift, true
+	}
+
+	// the numbers go from 1 to the sequence of the group without gaps, so if we have fewer events than that some
+	// were lost (the events from before we had numbers are all counted but have none, so they can only hide this)
+	drift.Truncated = events[0].Kind != nostr.KindSimpleGroupCreateGroup || int64(len(events)) < sequence
+
+	live.mu.RLock()
+	drift.Diff = DiffGroups(live, fresh)
+	var repairs []*nostr.Event
+	if repair && !drift.Truncated {
+		repairs = live.repairEvents(drift.Diff)
+	}
+	live.mu.RUnlock()
+	if drift.Diff.IsEmpty() {
+		return drift, false
+	}
+
+	if len(repairs) > 0 {
+		// these must come after everything in the database, even the events we never applied
+		when := nostr.Now()
+		if last := events[len(events)-1]; last.CreatedAt >= when {
+			when = last.CreatedAt + 1
+		}
+		for _, evt := range repairs {
+			evt.CreatedAt = when
+		}
+		if err := s.applyEventsLocked(ctx, repairs...); err != nil {
+			log.Warn().Err(err).Str("group", groupId).Msg("failed to repair group")
+			drift.RepairError = err.Error()
+		} else {
+			drift.Repaired = true
+		}
+	}
+	return drift, true
+}
+
+// sameAs compares the parts of a group that come from moderation events.
+func (group *Group) sameAs(other *Group) bool {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+	return DiffGroups(group, other).IsEmpty()
+}
+
+// repairEvents returns the moderation events that bring the database back to what we have in memory, it must be
+// called with the group lock held.
+func (group *Group) repairEvents(diff GroupDiff) []*nostr.Event {
+	id := group.Address.ID
+	events := make([]*nostr.Event, 0, 4)
+	for _, pubkey := range diff.MembersAdded {
+		// the database has someone we don't
+		events = append(events, &nostr.Event{
+			Kind: nostr.KindSimpleGroupRemoveUser,
+			Tags: nostr.Tags{{"h", id}, {"p", pubkey}},
+		})
+	}
+	for _, pubkey := range diff.MembersRemoved {
+		events = append(events, &nostr.Event{
+			Kind: nostr.KindSimpleGroupPutUser,
+			Tags: nostr.Tags{{"h", id}, append(nostr.Tag{"p", pubkey}, RoleNames(group.Members[pubkey])...)},
+		})
+	}
+	for _, pubkey := range slices.Sorted(maps.Keys(diff.RolesChanged)) {
+		events = append(events, &nostr.Event{
+			Kind: nostr.KindSimpleGroupPutUser,
+			Tags: nostr.Tags{{"h", id}, append(nostr.Tag{"p", pubkey}, RoleNames(group.Members[pubkey])...)},
+		})
+	}
+	if len(diff.MetadataChanged) > 0 {
+		tags := nostr.Tags{{"h", id}}
+		for _, field := range slices.Sorted(maps.Keys(diff.MetadataChanged)) {
+			switch field {
+			case "name":
+				tags = append(tags, nostr.Tag{"name", group.Name})
+			case "about":
+				tags = append(tags, nostr.Tag{"about", group.About})
+			case "picture":
+				tags = append(tags, nostr.Tag{"picture", group.Picture})
+			case "private":
+				if group.Private {
+					tags = append(tags, nostr.Tag{"private"})
+				} else {
+					tags = append(tags, nostr.Tag{"public"})
+				}
+			case "closed":
+				if group.Closed {
+					tags = append(tags, nostr.Tag{"closed"})
+				} else {
+					tags = append(tags, nostr.Tag{"open"})
+				}
+			case "topics":
+				if len(group.Topics) == 0 {
+					tags = append(tags, nostr.Tag{"t", ""})
+				}
+				for _, topic := range group.Topics {
+					tags = append(tags, nostr.Tag{"t", topic})
+				}
+			case "language":
+				tags = append(tags, nostr.Tag{"l", group.Language, "ISO-639-1"})
+			}
+		}
+		events = append(events, &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: tags})
+	}
+	return events
+}
+
+// RunConsistencyChecks checks (and optionally repairs) all groups every once in a while until ctx is canceled,
+// logging everything it finds.
+func (s *State) RunConsistencyChecks(ctx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		drifts, err := s.CheckConsistency(ctx, repair)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to check consistency")
+			continue
+		}
+		for _, drift := range drifts {
+			log.Warn().Str("group", drift.Group).Bool("missing", drift.Missing).Bool("unexpected", drift.Unexpected).
+				Bool("truncated", drift.Truncated).Interface("diff", drift.Diff).Bool("repaired", drift.Repaired).
+				Str("repair_error", drift.RepairError).Msg("group in memory differs from the database")
+		}
+	}
+}
+
+// ConsistencyHandler runs CheckConsistency over HTTP and returns the differences found, it repairs them if called
+// with POST and ?repair=true.
+//
+// This reveals everything about private groups, so it must only be mounted behind some form of authentication.
+func (s *State) ConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	repair := r.Method == http.MethodPost && r.URL.Query().Get("repair") == "true"
+	drifts, err := s.CheckConsistency(r.Context(), repair)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drifts)
+}
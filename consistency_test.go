@@ -0,0 +1,84 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsistency(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	creator := nostr.GeneratePrivateKey()
+	creatorPk, _ := nostr.GetPublicKey(creator)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	ghost, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	require.NoError(t, state.CreateGroup(ctx, "a", creatorPk, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "b", creatorPk, EditMetadata{}))
+	require.NoError(t, state.PutUser(ctx, "a", member, "moderator"))
+
+	drifts, err := state.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+
+	// someone gets into the group in memory only, and another one only in the database
+	group, _ := state.Groups.Load("a")
+	group.mu.Lock()
+	group.Members[member] = nil
+	group.Name = "renamed"
+	group.mu.Unlock()
+	sneaky := &nostr.Event{
+		CreatedAt: nostr.Now() + 1,
+		Kind:      nostr.KindSimpleGroupPutUser,
+		Tags:      nostr.Tags{{"h", "a"}, {"p", ghost}},
+	}
+	sneaky.Sign(creator)
+	saveSequenced(t, state, sneaky, group.Sequence()+1)
+
+	// and a group that is only in memory
+	state.Groups.Store("c", state.NewGroup("c", creatorPk))
+
+	drifts, err = state.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, drifts, 2)
+	require.Equal(t, "a", drifts[0].Group)
+	require.Equal(t, []string{ghost}, drifts[0].Diff.MembersAdded)
+	require.Equal(t, RolesChange{Before: []string{}, After: []string{"moderator"}}, drifts[0].Diff.RolesChanged[member])
+	require.Equal(t, ValueChange{Before: "renamed", After: ""}, drifts[0].Diff.MetadataChanged["name"])
+	require.Equal(t, "c", drifts[1].Group)
+	require.True(t, drifts[1].Unexpected)
+
+	// repairing makes the database agree with what we have
+	drifts, err = state.CheckConsistency(ctx, true)
+	require.NoError(t, err)
+	require.True(t, drifts[0].Repaired)
+	require.False(t, drifts[1].Repaired)
+
+	state.Groups.Delete("c")
+	drifts, err = state.CheckConsistency(ctx, false)
+	require.NoError(t, err)
+	require.Empty(t, drifts)
+
+	restarted, err := state.GroupAt(ctx, "a", nostr.Now()+10)
+	require.NoError(t, err)
+	require.Equal(t, "renamed", restarted.Name)
+	require.NotContains(t, restarted.Members, ghost)
+	require.Empty(t, restarted.Members[member])
+
+	// groups that lost part of their history in the database aren't repaired
+	require.NoError(t, state.PutUser(ctx, "b", member))
+	require.NoError(t, state.PutUser(ctx, "b", ghost))
+	history, _, err := state.moderationHistory(ctx, "b")
+	require.NoError(t, err)
+	require.NoError(t, state.DB.DeleteEvent(ctx, history[1]))
+	drifts, err = state.CheckConsistency(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, drifts, 1)
+	require.True(t, drifts[0].Truncated)
+	require.False(t, drifts[0].Repaired)
+	require.Equal(t, []string{member}, drifts[0].Diff.MembersRemoved)
+}
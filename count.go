@@ -0,0 +1,66 @@
+package relay29
+
+import (
+	"context"
+	"slices"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// CountEvents answers NIP-45 COUNT requests. it expects the filter to have gone through
+// RequireKindAndSingleGroupIDOrSpecificEventReference already, just like for normal queries.
+//
+// the metadata kinds are counted like this, which for two of them isn't what NIP-45 says (the number of events):
+//   - 39000: the number of groups that would be listed, one event each, like NIP-45 says;
+//   - 39001: the number of admins in the groups that match, not the number of events (one per group);
+//   - 39002: the number of members in the groups that match, not the number of events (one per group);
+//   - 39003: the number of groups, one event each, like NIP-45 says.
+//
+// nobody needs to count the 39001 and 39002 events, there is always one per group, but the number of admins and
+// members is what clients show and they can't get it otherwise without downloading the whole lists.
+func (s *State) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if slices.ContainsFunc(filter.Kinds, func(kind int) bool { return slices.Contains(nip29.MetadataEventKinds, kind) }) {
+		filter.Limit = 0
+		ch, err := s.MetadataEventsQueryHandler(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+
+		var count int64
+		for evt := range ch {
+			switch evt.Kind {
+			case nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers:
+				// the pubkeys, not the events
+				for _, tag := range evt.Tags {
+					if len(tag) >= 2 && tag[0] == "p" {
+						count++
+					}
+				}
+			case nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupRoles:
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	if hTags, hasHTags := filter.Tags["h"]; hasHTags && len(hTags) > 0 && filter.Search == "" {
+		// access to these groups was already checked, so we can count directly in the database if it knows how and
+		// if it has no expired events that would be counted
+		if counter, ok := s.DB.(eventstore.Counter); ok && s.expiration.nothingExpired(nostr.Now()) {
+			return counter.CountEvents(ctx, filter)
+		}
+	}
+
+	// otherwise we have to count the events we would return one by one, as some may be hidden
+	ch, err := s.NormalEventQuery(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for range ch {
+		count++
+	}
+	return count, nil
+}
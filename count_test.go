@@ -0,0 +1,144 @@
+package relay29
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCount(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	stranger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	yes := true
+
+	require.NoError(t, state.CreateGroup(ctx, "pub", ownerPk, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "priv", ownerPk, EditMetadata{PrivateValue: &yes}))
+	require.NoError(t, state.PutUser(ctx, "pub", member))
+
+	var lastPriv *nostr.Event
+	for i, group := range []string{"pub", "pub", "pub", "priv", "priv"} {
+		evt := &nostr.Event{CreatedAt: nostr.Now() + nostr.Timestamp(i), Kind: 9, Content: "hi", Tags: nostr.Tags{{"h", group}}}
+		evt.Sign(owner)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+		if group == "priv" {
+			lastPriv = evt
+		}
+	}
+
+	count := func(authed string, filter nostr.Filter) int64 {
+		state.GetAuthed = func(context.Context) string { return authed }
+		if rejected, _ := state.RequireKindAndSingleGroupIDOrSpecificEventReference(ctx, filter); rejected {
+			return -1
+		}
+		n, err := state.CountEvents(ctx, filter)
+		require.NoError(t, err)
+		return n
+	}
+
+	// messages
+	require.Equal(t, int64(3), count("", nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{"pub"}}}))
+	require.Equal(t, int64(-1), count(stranger, nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{"priv"}}}))
+	require.Equal(t, int64(2), count(ownerPk, nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{"priv"}}}))
+
+	// references to events in private groups are not counted for non-members
+	require.Equal(t, int64(0), count(stranger, nostr.Filter{IDs: []string{lastPriv.ID}}))
+	require.Equal(t, int64(1), count(ownerPk, nostr.Filter{IDs: []string{lastPriv.ID}}))
+
+	// groups (one event each)
+	require.Equal(t, int64(1), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata}}))
+	require.Equal(t, int64(2), count(ownerPk, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata}}))
+	both := nostr.TagMap{"d": []string{"pub", "priv"}}
+	require.Equal(t, int64(1), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupRoles}, Tags: both}))
+	require.Equal(t, int64(2), count(ownerPk, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupRoles}, Tags: both}))
+
+	// but members and admins instead of their lists (which are one per group)
+	require.Equal(t, int64(2), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": []string{"pub"}}}))
+	require.Equal(t, int64(0), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": []string{"priv"}}}))
+	require.Equal(t, int64(3), count(ownerPk, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMembers}, Tags: both}))
+	require.Equal(t, int64(1), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupAdmins}, Tags: nostr.TagMap{"d": []string{"pub"}}}))
+	require.Equal(t, int64(2), count(ownerPk, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupAdmins}, Tags: both}))
+
+	// each kind is counted its own way
+	require.Equal(t, int64(3), count(stranger, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupMembers}, Tags: nostr.TagMap{"d": []string{"pub"}}}))
+}
+
+func TestCountExpired(t *testing.T) {
+	ctx := context.Background()
+	online := newTestState()
+	require.NoError(t, online.CreateGroup(ctx, "g", online.publicKey, EditMetadata{}))
+	online.Close()
+
+	for _, expiration := range []nostr.Timestamp{nostr.Now() + 100, nostr.Now() - 1} {
+		evt := &nostr.Event{
+			CreatedAt: nostr.Now() - 10,
+			Kind:      9,
+			Tags:      nostr.Tags{{"h", "g"}, {"expiration", strconv.FormatInt(int64(expiration), 10)}},
+		}
+		evt.Sign(nostr.GeneratePrivateKey())
+		require.NoError(t, online.DB.SaveEvent(ctx, evt))
+	}
+	filter := nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{"g"}}}
+
+	// expired events that weren't deleted yet aren't counted
+	offline := New(Options{Domain: online.Domain, DB: online.DB, SecretKey: online.secretKey, NoBackgroundWork: true})
+	defer offline.Close()
+	offline.GetAuthed = online.GetAuthed
+	n, err := offline.CountEvents(ctx, filter)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	// and once they are the database counts by itself
+	restarted := New(Options{Domain: online.Domain, DB: online.DB, SecretKey: online.secretKey})
+	defer restarted.Close()
+	restarted.GetAuthed = online.GetAuthed
+	require.Eventually(t, func() bool { return restarted.expiration.nothingExpired(nostr.Now()) }, time.Second, time.Millisecond*10)
+	n, err = restarted.CountEvents(ctx, filter)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+}
+
+func TestExpirationForgetsAndRescans(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+	defer state.Close()
+	state.expiration.mu.Lock()
+	state.expiration.limit = 4
+	state.expiration.mu.Unlock()
+
+	author := nostr.GeneratePrivateKey()
+	authorPk, _ := nostr.GetPublicKey(author)
+	require.NoError(t, state.CreateGroup(ctx, "g", authorPk, EditMetadata{}))
+	for i := range 10 {
+		evt := &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      9,
+			Content:   strconv.Itoa(i),
+			Tags:      nostr.Tags{{"h", "g"}, {"expiration", strconv.FormatInt(int64(nostr.Now()+1+nostr.Timestamp(i%2)), 10)}},
+		}
+		evt.Sign(author)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+	}
+
+	// never more than the limit in memory
+	state.expiration.mu.Lock()
+	require.LessOrEqual(t, state.expiration.events.Len(), 4)
+	state.expiration.mu.Unlock()
+
+	// but the ones that were left out are still deleted in the end
+	filter := nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": []string{"g"}}}
+	require.Eventually(t, func() bool {
+		n, _ := state.DB.(*MemoryStore).CountEvents(ctx, filter)
+		return n == 0
+	}, time.Second*5, time.Millisecond*50)
+}
@@ -0,0 +1,105 @@
+package relay29
+
+import (
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// groups can have topics (["t", <topic>] tags) and a language (["l", <ISO-639-1 code>, "ISO-639-1"]) that are set
+// with edit-metadata events just like the name and the other fields, and these can be used for finding groups with
+// NIP-50 searches in 39000 queries, like {"kinds": [39000], "search": "bitcoin language:en sort:members"}.
+//
+// the search terms are matched against the name, about and topics of the groups. besides "language:" these
+// extensions are supported for ordering the results: "sort:members", "sort:activity" and "sort:created".
+
+// applyDirectoryFields applies the parts of an action that aren't part of a nip29.Group.
+// it must be called with the group lock held.
+func (group *Group) applyDirectoryFields(action Action) {
+	switch a := action.(type) {
+	case CreateGroup:
+		group.createdAt = a.When
+	case EditMetadata:
+		if a.TopicsValue != nil {
+			group.Topics = *a.TopicsValue
+		}
+		if a.LanguageValue != nil {
+			group.Language = *a.LanguageValue
+		}
+	case MoveGroup:
+		group.MovedTo = a.To
+	case Revert:
+		for _, undo := range a.Undo {
+			group.applyDirectoryFields(undo)
+		}
+	}
+}
+
+// applyAction applies an action to the group, including the parts that aren't part of a nip29.Group.
+func (group *Group) applyAction(action Action) {
+	action.Apply(&group.Group)
+	group.applyDirectoryFields(action)
+}
+
+// touchActivity takes note of the time of the last event published to the group.
+func (group *Group) touchActivity(ts nostr.Timestamp) {
+	if int64(ts) > group.lastActivity.Load() {
+		group.lastActivity.Store(int64(ts))
+	}
+}
+
+type directorySearch struct {
+	terms    []string
+	language string
+	sort     string
+}
+
+func parseDirectorySearch(search string) directorySearch {
+	var ds directorySearch
+	for _, word := range strings.Fields(strings.ToLower(search)) {
+		if key, value, isExtension := strings.Cut(word, ":"); isExtension {
+			switch key {
+			case "language":
+				ds.language = value
+			case "sort":
+				ds.sort = value
+			}
+			continue
+		}
+		ds.terms = append(ds.terms, word)
+	}
+	return ds
+}
+
+// matches must be called with the group lock held (for reading, at least).
+func (ds directorySearch) matches(group *Group) bool {
+	if ds.language != "" && !strings.EqualFold(ds.language, group.Language) {
+		return false
+	}
+
+	if len(ds.terms) == 0 {
+		return true
+	}
+	text := strings.ToLower(group.Name + " " + group.About + " " + strings.Join(group.Topics, " "))
+	for _, term := range ds.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortKey tells where a group goes in the results (higher first), or returns the given default for when no sort
+// order was specified. it must be called with the group lock held (for reading, at least).
+func (ds directorySearch) sortKey(group *Group, def nostr.Timestamp) int64 {
+	switch ds.sort {
+	case "members":
+		return int64(len(group.Members))
+	case "activity":
+		return group.lastActivity.Load()
+	case "created":
+		return int64(group.createdAt)
+	default:
+		return int64(def)
+	}
+}
@@ -0,0 +1,74 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectory(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	create := func(id string, name string, language string, topics ...string) {
+		require.NoError(t, state.CreateGroup(ctx, id, owner, EditMetadata{
+			NameValue:     &name,
+			TopicsValue:   &topics,
+			LanguageValue: &language,
+		}))
+	}
+	create("btc", "Bitcoin Talk", "en", "bitcoin", "money")
+	create("btcbr", "Papo de Bitcoin", "pt", "bitcoin")
+	create("cats", "Cats", "en", "pets")
+	require.NoError(t, state.PutUser(ctx, "btcbr", member))
+
+	search := func(search string) []string {
+		ch, err := state.MetadataEventsQueryHandler(ctx, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata}, Search: search})
+		require.NoError(t, err)
+		ids := make([]string, 0, 3)
+		for evt := range ch {
+			ids = append(ids, evt.Tags.GetD())
+		}
+		return ids
+	}
+
+	require.ElementsMatch(t, []string{"btc", "btcbr"}, search("bitcoin"))
+	require.Equal(t, []string{"btc"}, search("bitcoin language:en"))
+	require.Equal(t, []string{"btc"}, search("TALK"))
+	require.Equal(t, []string{"cats"}, search("pets"))
+	require.Equal(t, []string{"btcbr", "btc"}, search("bitcoin sort:members"))
+
+	// the topics and the language are in the metadata event and can also be used in filters
+	ch, _ := state.MetadataEventsQueryHandler(ctx, nostr.Filter{
+		Kinds: []int{nostr.KindSimpleGroupMetadata},
+		Tags:  nostr.TagMap{"t": []string{"money"}},
+	})
+	evt := <-ch
+	require.Equal(t, "btc", evt.Tags.GetD())
+	require.NotNil(t, evt.Tags.GetFirst([]string{"l", "en"}))
+
+	// topics can be changed and cleared
+	require.NoError(t, state.applyEvents(ctx, &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindSimpleGroupEditMetadata,
+		Tags:      nostr.Tags{{"h", "cats"}, {"t", ""}},
+	}))
+	require.Empty(t, search("pets"))
+
+	// and all of this survives a restart
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+	})
+	group, _ := restarted.Groups.Load("btc")
+	require.Equal(t, []string{"bitcoin", "money"}, group.Topics)
+	require.Equal(t, "en", group.Language)
+}
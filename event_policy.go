@@ -3,10 +3,11 @@ package relay29
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip29"
 	"github.com/rs/zerolog/log"
 )
 
@@ -19,6 +20,11 @@ func (s *State) RequireHTagForExistingGroup(ctx context.Context, event *nostr.Ev
 		return true, "missing group (`h`) tag"
 	}
 
+	// with other processes around we may not know about the latest changes yet (see cluster.go)
+	if ModerationEventKinds.Includes(event.Kind) || s.GetGroupFromEvent(event) == nil {
+		s.catchUp(ctx, (*gtag)[1])
+	}
+
 	// skip this check when creating a group
 	if event.Kind == nostr.KindSimpleGroupCreateGroup {
 		return false, ""
@@ -33,8 +39,27 @@ func (s *State) RequireHTagForExistingGroup(ctx context.Context, event *nostr.Ev
 }
 
 func (s *State) RestrictWritesBasedOnGroupRules(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind == KindSimpleGroupAuditEntry {
+		return true, "blocked: audit entries are generated by the relay"
+	}
+	if event.Kind == KindSimpleGroupMembersDelta {
+		return true, "blocked: members deltas are generated by the relay"
+	}
+
 	group := s.GetGroupFromEvent(event)
 
+	if group != nil {
+		group.mu.RLock()
+		movedTo, exporting := group.MovedTo, group.exporting
+		group.mu.RUnlock()
+		if movedTo.Relay != "" {
+			return true, "blocked: this group has moved to " + movedTo.Relay
+		}
+		if exporting {
+			return true, "blocked: this group is moving to another relay"
+		}
+	}
+
 	if event.Kind == nostr.KindSimpleGroupJoinRequest {
 		// anyone can apply to enter any group (if this is not desired a policy must be added to filter out this stuff)
 		group.mu.RLock()
@@ -80,14 +105,14 @@ func (s *State) PreventWritingOfEventsJustDeleted(ctx context.Context, event *no
 
 func (s *State) RequireModerationEventsToBeRecent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 	// moderation action events must be new and not reused
-	if nip29.ModerationEventKinds.Includes(event.Kind) && event.CreatedAt < nostr.Now()-tooOld {
+	if ModerationEventKinds.Includes(event.Kind) && event.CreatedAt < nostr.Now()-tooOld {
 		return true, "moderation action is too old (older than 1 minute ago)"
 	}
 	return false, ""
 }
 
 func (s *State) RestrictInvalidModerationActions(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-	if !nip29.ModerationEventKinds.Includes(event.Kind) {
+	if !ModerationEventKinds.Includes(event.Kind) {
 		return false, ""
 	}
 
@@ -97,16 +122,40 @@ func (s *State) RestrictInvalidModerationActions(ctx context.Context, event *nos
 		return false, ""
 	}
 
+	// reverts must point to something that can be reverted, and only the author of the original action
+	// or someone with a higher role can revert it
+	var revert *Revert
+	if event.Kind == KindSimpleGroupRevert {
+		target, prepared, err := s.prepareRevert(ctx, event)
+		if err != nil {
+			return true, "invalid revert: " + err.Error()
+		}
+		group.mu.RLock()
+		allowed := event.PubKey == s.publicKey || event.PubKey == target.PubKey ||
+			s.outranks(group.Group, event.PubKey, target.PubKey)
+		group.mu.RUnlock()
+		if !allowed {
+			return true, "insufficient permissions: only the author or someone with a higher role can revert this"
+		}
+		revert = &prepared
+	}
+
 	// will check if the moderation event author has sufficient permissions to perform this action
 	// except for the relay owner/pubkey, that has infinite permissions already
 	if event.PubKey == s.publicKey {
 		return false, ""
 	}
+	if event.Kind == KindSimpleGroupMoved {
+		return true, "blocked: only the relay can move a group"
+	}
 
 	action, err := PrepareModerationAction(event)
 	if err != nil {
 		return true, "invalid moderation action: " + err.Error()
 	}
+	if revert != nil {
+		action = *revert
+	}
 
 	if egs, ok := action.(EditMetadata); ok && egs.PrivateValue != nil && *egs.PrivateValue && !s.AllowPrivateGroups {
 		return true, "groups cannot be private"
@@ -139,6 +188,8 @@ func (s *State) CheckPreviousTag(ctx context.Context, event *nostr.Event) (rejec
 	}
 
 	group := s.GetGroupFromEvent(event)
+	group.mu.RLock()
+	defer group.mu.RUnlock()
 	for _, idFirstChars := range (*previous)[1:] {
 		if len(idFirstChars) > 64 {
 			return true, fmt.Sprintf("invalid value '%s' in previous tag", idFirstChars)
@@ -167,16 +218,112 @@ func (s *State) AddToPreviousChecking(ctx context.Context, event *nostr.Event) {
 		return
 	}
 	lastIndex := group.last50index.Add(1) - 1
+	group.mu.Lock()
 	group.last50[lastIndex%50] = event.ID
+	group.mu.Unlock()
+	group.touchActivity(event.CreatedAt)
 }
 
 func (s *State) ApplyModerationAction(ctx context.Context, event *nostr.Event) {
+	if IsInternalCall(ctx) {
+		// these were already applied by applyEvents
+		return
+	}
+
 	// turn event into a moderation action processor
-	action, err := PrepareModerationAction(event)
+	action, err := s.prepareModerationAction(event)
 	if err != nil {
 		return
 	}
+	if event.Kind == KindSimpleGroupRevert {
+		_, revert, err := s.prepareRevert(ctx, event)
+		if err != nil {
+			log.Warn().Err(err).Stringer("event", event).Msg("failed to prepare revert")
+			return
+		}
+		action = revert
+	}
+
+	s.moderationMu.Lock()
+	if !s.canApply(event) {
+		// something else got applied since this was accepted (like the group being deleted), and we must end up with
+		// what we would get from replaying the database, so that's what we do
+		log.Warn().Stringer("event", event).Msg("moderation event can't be applied anymore, rebuilding group")
+		s.resyncGroup(ctx, GetGroupIDFromEvent(event))
+		s.moderationMu.Unlock()
+		return
+	}
+
+	sequence := sequenceTag(event, s.publicKey)
+	if sequence == 0 {
+		if s.replication.following.Load() {
+			// we'll apply it when the leader tells us where it goes
+			s.moderationMu.Unlock()
+			return
+		}
+		var ok bool
+		if sequence, ok = s.nextSequence(ctx, event); !ok {
+			s.moderationMu.Unlock()
+			return
+		}
+	} else if group := s.GetGroupFromEvent(event); group != nil && sequence != group.Sequence()+1 {
+		// we missed something (this can only be a follower getting our own events from the leader)
+		s.resyncGroup(ctx, GetGroupIDFromEvent(event))
+		s.moderationMu.Unlock()
+		return
+	}
+
+	// take note of this in the audit log (before we apply it so we know the roles the actor had at the time)
+	s.recordModerationAttempt(event, true, "", "")
+
+	group, kinds := s.applyModerationAction(ctx, event, action, sequence)
+	if sequenceTag(event, s.publicKey) != 0 &&
+		s.claimSequence(ctx, group.Address.ID, group.sequence-1, group.sequence) {
+		// the group was rebuilt and everything was already broadcasted
+		s.moderationMu.Unlock()
+		return
+	}
+	s.moderationMu.Unlock()
+
+	// propagate new replaceable events to listeners depending on what changed happened
+	s.broadcastMetadata(group, kinds...)
+}
+
+// metadataKindsChangedBy tells which metadata events must be rebroadcasted after each kind of moderation event
+// (the admins event is also rebroadcasted whenever the admins change, see applyModerationAction)
+var metadataKindsChangedBy = map[int][]int{
+	nostr.KindSimpleGroupCreateGroup: {
+		nostr.KindSimpleGroupMetadata,
+		nostr.KindSimpleGroupAdmins,
+		nostr.KindSimpleGroupMembers,
+		KindSimpleGroupMembersDelta,
+		nostr.KindSimpleGroupRoles,
+	},
+	nostr.KindSimpleGroupEditMetadata: {
+		nostr.KindSimpleGroupMetadata,
+	},
+	KindSimpleGroupMoved: {
+		nostr.KindSimpleGroupMetadata,
+	},
+	nostr.KindSimpleGroupPutUser: {
+		nostr.KindSimpleGroupMembers,
+		KindSimpleGroupMembersDelta,
+	},
+	nostr.KindSimpleGroupRemoveUser: {
+		nostr.KindSimpleGroupMembers,
+		KindSimpleGroupMembersDelta,
+	},
+	KindSimpleGroupRevert: {
+		nostr.KindSimpleGroupMetadata,
+		nostr.KindSimpleGroupMembers,
+		KindSimpleGroupMembersDelta,
+	},
+}
 
+// applyModerationAction changes the in-memory group state and does whatever else the action requires, then returns
+// the group and the metadata event kinds that must be rebroadcasted. sequence is the number the event got in the
+// sequence of the group. it must be called with moderationMu held.
+func (s *State) applyModerationAction(ctx context.Context, event *nostr.Event, action Action, sequence int64) (*Group, []int) {
 	// get group (or create it)
 	var group *Group
 	if event.Kind == nostr.KindSimpleGroupCreateGroup {
@@ -191,7 +338,18 @@ func (s *State) ApplyModerationAction(ctx context.Context, event *nostr.Event) {
 
 	// apply the moderation action
 	group.mu.Lock()
-	action.Apply(&group.Group)
+	touched := membersTouchedBy(action)
+	if _, isDelete := action.(DeleteGroup); isDelete {
+		touched = slices.Collect(maps.Keys(group.Members))
+	}
+	adminsBefore := group.adminsSignature(touched)
+	group.applyAction(action)
+	adminsChanged := group.adminsSignature(touched) != adminsBefore
+	group.sequence = sequence
+	group.lastModeration = event.ID
+	group.invalidateCaches()
+	group.recordMembershipChanges(action)
+	s.updateMemberships(group, touched)
 	group.mu.Unlock()
 
 	// if it's a delete event we have to actually delete stuff from the database here
@@ -212,6 +370,8 @@ func (s *State) ApplyModerationAction(ctx context.Context, event *nostr.Event) {
 					if err := s.DB.DeleteEvent(ctx, target); err != nil {
 						log.Warn().Err(err).Stringer("event", target).Msg("failed to delete")
 					} else {
+						s.RemoveFromSearchIndex(ctx, target)
+						s.RemoveFromNegentropyIndex(ctx, target)
 						s.deletedCache.Add(target.ID)
 						go func(id string) {
 							time.Sleep(tooOld * time.Second)
@@ -226,27 +386,43 @@ func (s *State) ApplyModerationAction(ctx context.Context, event *nostr.Event) {
 		s.Groups.Delete(group.Address.ID)
 	}
 
-	// propagate new replaceable events to listeners depending on what changed happened
-	for _, toBroadcast := range map[int][]func() *nostr.Event{
-		nostr.KindSimpleGroupCreateGroup: {
-			group.ToMetadataEvent,
-			group.ToAdminsEvent,
-			group.ToMembersEvent,
-			group.ToRolesEvent,
-		},
-		nostr.KindSimpleGroupEditMetadata: {
-			group.ToMetadataEvent,
-		},
-		nostr.KindSimpleGroupPutUser: {
-			group.ToMembersEvent,
-			group.ToAdminsEvent,
-		},
-		nostr.KindSimpleGroupRemoveUser: {
-			group.ToMembersEvent,
-		},
-	}[event.Kind] {
-		evt := toBroadcast()
-		evt.Sign(s.secretKey)
+	kinds := metadataKindsChangedBy[event.Kind]
+	if adminsChanged && !slices.Contains(kinds, nostr.KindSimpleGroupAdmins) {
+		kinds = append(slices.Clone(kinds), nostr.KindSimpleGroupAdmins)
+	}
+
+	return group, kinds
+}
+
+// broadcastMetadata signs and broadcasts the given metadata event kinds for a group.
+func (s *State) broadcastMetadata(group *Group, kinds ...int) {
+	sent := make([]int, 0, len(kinds))
+	for _, kind := range kinds {
+		if slices.Contains(sent, kind) {
+			continue
+		}
+		sent = append(sent, kind)
+
+		var evt *nostr.Event
+		group.mu.RLock()
+		switch kind {
+		case nostr.KindSimpleGroupMembers:
+			if s.fullMembersListLimit > 0 && len(group.Members) > s.fullMembersListLimit {
+				// too big, clients will have to make do with the deltas
+				break
+			}
+			evt = s.signedMetadataEvent(group, kind)
+		case KindSimpleGroupMembersDelta:
+			evt = group.ToMembersDeltaEvent(group.membersBroadcasted.Swap(group.sequence))
+			evt.Sign(s.secretKey)
+		default:
+			evt = s.signedMetadataEvent(group, kind)
+		}
+		group.mu.RUnlock()
+		if evt == nil {
+			continue
+		}
+
 		s.Relay.BroadcastEvent(evt)
 	}
 }
@@ -282,23 +458,9 @@ func (s *State) ReactToJoinRequest(ctx context.Context, event *nostr.Event) {
 	}
 
 	// immediately add the requester
-	addUser := &nostr.Event{
-		CreatedAt: nostr.Now(),
-		Kind:      nostr.KindSimpleGroupPutUser,
-		Tags: nostr.Tags{
-			nostr.Tag{"h", group.Address.ID},
-			nostr.Tag{"p", event.PubKey},
-		},
-	}
-	if err := addUser.Sign(s.secretKey); err != nil {
-		log.Error().Err(err).Msg("failed to sign add-user event")
-		return
-	}
-	if _, err := s.Relay.AddEvent(ctx, addUser); err != nil {
+	if err := s.PutUser(ctx, group.Address.ID, event.PubKey); err != nil {
 		log.Error().Err(err).Msg("failed to add user who requested to join")
-		return
 	}
-	s.Relay.BroadcastEvent(addUser)
 }
 
 func (s *State) ReactToLeaveRequest(ctx context.Context, event *nostr.Event) {
@@ -310,22 +472,8 @@ func (s *State) ReactToLeaveRequest(ctx context.Context, event *nostr.Event) {
 
 	if _, isMember := group.Members[event.PubKey]; isMember {
 		// immediately remove the requester
-		removeUser := &nostr.Event{
-			CreatedAt: nostr.Now(),
-			Kind:      nostr.KindSimpleGroupRemoveUser,
-			Tags: nostr.Tags{
-				nostr.Tag{"h", group.Address.ID},
-				nostr.Tag{"p", event.PubKey},
-			},
-		}
-		if err := removeUser.Sign(s.secretKey); err != nil {
-			log.Error().Err(err).Msg("failed to sign remove-user event")
-			return
-		}
-		if _, err := s.Relay.AddEvent(ctx, removeUser); err != nil {
+		if err := s.RemoveUserFromGroup(ctx, group.Address.ID, event.PubKey); err != nil {
 			log.Error().Err(err).Msg("failed to remove user who requested to leave")
-			return
 		}
-		s.Relay.BroadcastEvent(removeUser)
 	}
 }
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/fiatjaf/eventstore/slicestore"
 	"github.com/fiatjaf/khatru/policies"
 	"github.com/fiatjaf/relay29"
 	"github.com/fiatjaf/relay29/khatru29"
@@ -23,7 +22,7 @@ var (
 func main() {
 	relayPrivateKey := nostr.GeneratePrivateKey()
 
-	db := &slicestore.SliceStore{}
+	db := &relay29.MemoryStore{} // this only keeps things in memory, use a different eventstore in production
 	db.Init()
 
 	relay, state := khatru29.Init(relay29.Options{
@@ -58,6 +57,11 @@ func main() {
 		return false
 	}
 
+	// and these are the ones listed as admins
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool {
+		return role == adminRole || role == moderatorRole
+	}
+
 	// init relay
 	relay.Info.Name = "very ephemeral chat relay"
 	relay.Info.Description = "everything will be deleted as soon as I turn off my computer"
@@ -69,7 +73,7 @@ func main() {
 		policies.RestrictToSpecifiedKinds(true,
 			9, 10, 11, 12, 1111,
 			30023, 31922, 31923, 9802,
-			9000, 9001, 9002, 9003, 9004, 9005, 9006, 9007,
+			9000, 9001, 9002, 9003, 9004, 9005, 9006, 9007, 9010,
 			9021, 9022,
 		),
 		policies.PreventTimestampsInThePast(60*time.Second),
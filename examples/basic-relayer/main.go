@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"slices"
 
-	"github.com/fiatjaf/eventstore/slicestore"
 	"github.com/fiatjaf/relay29"
 	"github.com/fiatjaf/relay29/relayer29"
 	"github.com/fiatjaf/relayer/v2"
@@ -23,7 +22,7 @@ var (
 func main() {
 	relayPrivateKey := nostr.GeneratePrivateKey()
 
-	db := &slicestore.SliceStore{}
+	db := &relay29.MemoryStore{} // this only keeps things in memory, use a different eventstore in production
 	db.Init()
 
 	host := "0.0.0.0"
@@ -61,6 +60,11 @@ func main() {
 		return false
 	}
 
+	// and these are the ones listed as admins
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool {
+		return role == adminRole || role == moderatorRole
+	}
+
 	relay.(*relayer29.Relay).RejectFunc = func(ev *nostr.Event) (bool, string) {
 		for _, tag := range ev.Tags {
 			if len(tag) > 1 && len(tag[0]) == 1 {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"net/http"
 	"os"
-	"slices"
 	"time"
 
 	"github.com/fiatjaf/eventstore/lmdb"
@@ -67,6 +66,7 @@ func main() {
 		SecretKey:               s.RelayPrivkey,
 		DefaultRoles:            []*nip29.Role{kingRole, bishopRole},
 		GroupCreatorDefaultRole: kingRole,
+		EnableSearch:            true,
 	})
 
 	// setup group-related restrictions
@@ -93,6 +93,11 @@ func main() {
 		return false
 	}
 
+	// and these are the ones listed as admins
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool {
+		return role == kingRole || role == bishopRole
+	}
+
 	// init relay
 	relay.Info.Name = s.RelayName
 	relay.Info.Description = s.RelayDescription
@@ -102,20 +107,27 @@ func main() {
 	relay.OverwriteDeletionOutcome = append(relay.OverwriteDeletionOutcome,
 		blockDeletesOfOldMessages,
 	)
-	relay.RejectEvent = slices.Insert(relay.RejectEvent, 2,
-		policies.PreventLargeTags(64),
-		policies.PreventTooManyIndexableTags(6, []int{9005}, nil),
-		policies.RestrictToSpecifiedKinds(true,
+	after := "RequireModerationEventsToBeRecent"
+	for _, policy := range []struct {
+		name string
+		fn   func(context.Context, *nostr.Event) (bool, string)
+	}{
+		{"PreventLargeTags", policies.PreventLargeTags(64)},
+		{"PreventTooManyIndexableTags", policies.PreventTooManyIndexableTags(6, []int{9005}, nil)},
+		{"RestrictToSpecifiedKinds", policies.RestrictToSpecifiedKinds(true,
 			9, 10, 11, 12, 1111,
 			30023, 31922, 31923, 9802,
-			9000, 9001, 9002, 9003, 9004, 9005, 9006, 9007,
+			9000, 9001, 9002, 9003, 9004, 9005, 9006, 9007, 9010,
 			9021, 9022,
-		),
-		policies.PreventTimestampsInThePast(60*time.Second),
-		policies.PreventTimestampsInTheFuture(30*time.Second),
-		rateLimit,
-		preventGroupCreation,
-	)
+		)},
+		{"PreventTimestampsInThePast", policies.PreventTimestampsInThePast(60 * time.Second)},
+		{"PreventTimestampsInTheFuture", policies.PreventTimestampsInTheFuture(30 * time.Second)},
+		{"rateLimit", rateLimit},
+		{"preventGroupCreation", preventGroupCreation},
+	} {
+		state.Pipeline.RejectEvent.InsertAfter(after, policy.name, policy.fn)
+		after = policy.name
+	}
 
 	// http routes
 	relay.Router().HandleFunc("/create", handleCreateGroup)
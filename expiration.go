@@ -0,0 +1,216 @@
+package relay29
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+	"github.com/rs/zerolog/log"
+)
+
+type expiringEvent struct {
+	id        string
+	expiresAt nostr.Timestamp
+}
+
+type expiringEventHeap []expiringEvent
+
+func (h expiringEventHeap) Len() int           { return len(h) }
+func (h expiringEventHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h expiringEventHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiringEventHeap) Push(x any)        { *h = append(*h, x.(expiringEvent)) }
+func (h *expiringEventHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// expirationScheduler keeps track of the events that have an "expiration" tag (NIP-40) and deletes them from the
+// database as soon as they expire. only the ones that expire sooner are kept in memory, when there are too many the
+// rest is forgotten and picked up again from the database later, when these are gone.
+type expirationScheduler struct {
+	mu     sync.Mutex
+	events expiringEventHeap
+	wake   chan struct{}
+	limit  int
+
+	// forgotten is when the first of the events we had to forget expires (0 if none were)
+	forgotten nostr.Timestamp
+
+	// scanned is set once all the events in the database were looked at, deleting is the number of events that
+	// were taken from the heap but are still in the database
+	scanned  bool
+	deleting int
+}
+
+// how many expiring events are kept in memory
+const maxScheduledExpirations = 10000
+
+func (s *State) RejectExpiredEvents(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	expiresAt := nip40.GetExpiration(event.Tags)
+	if expiresAt == -1 {
+		return false, ""
+	}
+
+	// moderation events must stay around forever otherwise we won't be able to rebuild the group state
+	if ModerationEventKinds.Includes(event.Kind) {
+		return true, "invalid: moderation actions can't expire"
+	}
+
+	if expiresAt <= nostr.Now() {
+		return true, "invalid: event is already expired"
+	}
+
+	return false, ""
+}
+
+func (s *State) ScheduleExpiration(ctx context.Context, event *nostr.Event) {
+	if expiresAt := nip40.GetExpiration(event.Tags); expiresAt != -1 {
+		s.expiration.schedule(event.ID, expiresAt)
+	}
+}
+
+func isExpired(event *nostr.Event, now nostr.Timestamp) bool {
+	expiresAt := nip40.GetExpiration(event.Tags)
+	return expiresAt != -1 && expiresAt <= now
+}
+
+// nothingExpired tells if we know for sure that no expired event is still in the database.
+func (es *expirationScheduler) nothingExpired(now nostr.Timestamp) bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.scanned && es.deleting == 0 && (es.events.Len() == 0 || es.events[0].expiresAt > now) &&
+		(es.forgotten == 0 || es.forgotten > now)
+}
+
+func (es *expirationScheduler) schedule(id string, expiresAt nostr.Timestamp) {
+	es.mu.Lock()
+	if es.forgotten != 0 && expiresAt >= es.forgotten {
+		// this will be picked up with the others we forgot
+		es.mu.Unlock()
+		return
+	}
+	heap.Push(&es.events, expiringEvent{id: id, expiresAt: expiresAt})
+	if es.events.Len() > es.limit {
+		// keep the half that expires first (a sorted slice is still a heap)
+		slices.SortFunc(es.events, func(a, b expiringEvent) int { return cmp.Compare(a.expiresAt, b.expiresAt) })
+		half := es.events.Len() / 2
+		es.forgotten = es.events[half].expiresAt
+		es.events = es.events[0:half]
+	}
+	es.mu.Unlock()
+
+	select {
+	case es.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next tells when the scheduler has to do something again.
+func (es *expirationScheduler) next() time.Duration {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.events.Len() > 0 {
+		return time.Until(es.events[0].expiresAt.Time())
+	} else if es.forgotten != 0 {
+		return time.Until(es.forgotten.Time())
+	}
+	return time.Hour
+}
+
+func (s *State) runExpirationScheduler(ctx context.Context) {
+	// pick up the events that were already in the database when we started
+	s.background(s.scanForExpiringEvents)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		timer.Reset(s.expiration.next())
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.expiration.wake:
+			continue
+		case <-timer.C:
+		}
+
+		// keep deleting events as long as they're expired
+		now := nostr.Now()
+		for {
+			s.expiration.mu.Lock()
+			if s.expiration.events.Len() == 0 || s.expiration.events[0].expiresAt > now {
+				s.expiration.mu.Unlock()
+				break
+			}
+			next := heap.Pop(&s.expiration.events).(expiringEvent)
+			s.expiration.deleting++
+			s.expiration.mu.Unlock()
+
+			s.deleteExpiredEvent(ctx, next.id)
+
+			s.expiration.mu.Lock()
+			s.expiration.deleting--
+			s.expiration.mu.Unlock()
+		}
+
+		// when we're done with the ones we had we go get the ones we forgot
+		s.expiration.mu.Lock()
+		rescan := s.expiration.events.Len() == 0 && s.expiration.forgotten != 0 && s.expiration.forgotten <= now
+		if rescan {
+			s.expiration.forgotten = 0
+			s.expiration.scanned = false
+		}
+		s.expiration.mu.Unlock()
+		if rescan {
+			s.scanForExpiringEvents(ctx)
+		}
+	}
+}
+
+func (s *State) deleteExpiredEvent(ctx context.Context, id string) {
+	res, err := s.DB.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("failed to query expired event")
+		return
+	}
+	for target := range res {
+		if err := s.DB.DeleteEvent(ctx, target); err != nil {
+			log.Warn().Err(err).Stringer("event", target).Msg("failed to delete expired event")
+		}
+		s.RemoveFromSearchIndex(ctx, target)
+		s.RemoveFromNegentropyIndex(ctx, target)
+	}
+}
+
+func (s *State) scanForExpiringEvents(ctx context.Context) {
+	for id := range s.Groups.Range {
+		if ctx.Err() != nil {
+			return
+		}
+		s.eachGroupEvent(ctx, id, func(evt *nostr.Event) {
+			if expiresAt := nip40.GetExpiration(evt.Tags); expiresAt != -1 {
+				s.expiration.schedule(evt.ID, expiresAt)
+			}
+		})
+	}
+
+	s.expiration.mu.Lock()
+	s.expiration.scanned = true
+	s.expiration.mu.Unlock()
+}
+
+// eachGroupEvent goes through all the events of a group we have in the database, newest first.
+func (s *State) eachGroupEvent(ctx context.Context, groupId string, fn func(*nostr.Event)) {
+	if err := PageEvents(ctx, s.DB.QueryEvents, nostr.Filter{Tags: nostr.TagMap{"h": []string{groupId}}}, fn); err != nil {
+		log.Warn().Err(err).Str("group", groupId).Msg("failed to scan group events")
+	}
+}
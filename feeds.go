@@ -0,0 +1,50 @@
+package relay29
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// feeds are filters without "h", "e", "a" or "ids" but with "#p" or "authors", like "everything mentioning me in my
+// groups" or "the latest messages from these people in my groups". they're only accepted from authenticated users
+// and are run against all the groups the user is a member of (or the ones with the most recent activity among
+// these, if there are more than MaxFeedGroups).
+
+func isFeedQuery(filter nostr.Filter) bool {
+	_, hasPTags := filter.Tags["p"]
+	return hasPTags || len(filter.Authors) > 0
+}
+
+// expandFeed adds the "h" tags of the groups a feed query will run against, returns false if there are none.
+func (s *State) expandFeed(filter nostr.Filter, authed string) (nostr.Filter, bool) {
+	if authed == "" || s.MaxFeedGroups <= 0 {
+		return filter, false
+	}
+
+	groupIds := slices.Collect(maps.Keys(s.Memberships(authed)))
+	if len(groupIds) == 0 {
+		return filter, false
+	}
+
+	if len(groupIds) > s.MaxFeedGroups {
+		activity := make(map[string]int64, len(groupIds))
+		for _, id := range groupIds {
+			if group, _ := s.Groups.Load(id); group != nil {
+				activity[id] = group.lastActivity.Load()
+			}
+		}
+		slices.SortFunc(groupIds, func(a, b string) int { return cmp.Compare(activity[b], activity[a]) })
+		groupIds = groupIds[0:s.MaxFeedGroups]
+	}
+
+	expanded := filter
+	expanded.Tags = make(nostr.TagMap, len(filter.Tags)+1)
+	for k, v := range filter.Tags {
+		expanded.Tags[k] = v
+	}
+	expanded.Tags["h"] = groupIds
+	return expanded, true
+}
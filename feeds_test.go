@@ -0,0 +1,71 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeds(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	stranger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	yes := true
+
+	require.NoError(t, state.CreateGroup(ctx, "a", ownerPk, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "b", ownerPk, EditMetadata{PrivateValue: &yes}))
+	require.NoError(t, state.CreateGroup(ctx, "c", ownerPk, EditMetadata{}))
+	require.NoError(t, state.PutUser(ctx, "a", member))
+	require.NoError(t, state.PutUser(ctx, "b", member))
+
+	for i, group := range []string{"a", "b", "c"} {
+		evt := &nostr.Event{
+			CreatedAt: nostr.Now() + nostr.Timestamp(i),
+			Kind:      9,
+			Content:   "hey",
+			Tags:      nostr.Tags{{"h", group}, {"p", member}},
+		}
+		evt.Sign(owner)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+		state.AddToPreviousChecking(ctx, evt)
+	}
+
+	query := func(authed string, filter nostr.Filter) []string {
+		state.GetAuthed = func(context.Context) string { return authed }
+		if rejected, _ := state.RequireKindAndSingleGroupIDOrSpecificEventReference(ctx, filter); rejected {
+			return nil
+		}
+		ch, err := state.NormalEventQuery(ctx, filter)
+		require.NoError(t, err)
+		groups := make([]string, 0, 3)
+		for evt := range ch {
+			groups = append(groups, evt.Tags.GetFirst([]string{"h", ""}).Value())
+		}
+		return groups
+	}
+
+	mentions := nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"p": []string{member}}}
+
+	// only in the groups we're in
+	require.Nil(t, query("", mentions))
+	require.ElementsMatch(t, []string{"a", "b"}, query(member, mentions))
+	require.Empty(t, query(stranger, mentions))
+	require.ElementsMatch(t, []string{"a", "b", "c"}, query(ownerPk, nostr.Filter{Authors: []string{ownerPk}, Kinds: []int{9}}))
+
+	// capped to the most active groups
+	state.MaxFeedGroups = 1
+	require.Equal(t, []string{"b"}, query(member, mentions))
+
+	// or disabled
+	state.MaxFeedGroups = 0
+	rejected, msg := state.RequireKindAndSingleGroupIDOrSpecificEventReference(ctx, mentions)
+	require.True(t, rejected)
+	require.Contains(t, msg, "disabled")
+}
@@ -12,6 +12,11 @@ func (s *State) RequireKindAndSingleGroupIDOrSpecificEventReference(
 	ctx context.Context,
 	filter nostr.Filter,
 ) (reject bool, msg string) {
+	if s.GetAuthed(ctx) == s.publicKey {
+		// this is a follower, it can read everything (see replication.go)
+		return false, ""
+	}
+
 	isMeta := false
 	isNormal := false
 	isReference := false
@@ -77,6 +82,15 @@ func (s *State) RequireKindAndSingleGroupIDOrSpecificEventReference(
 		} else if len(filter.IDs) > 0 {
 			// "ids" specified -- idem
 			return false, ""
+		} else if isFeedQuery(filter) {
+			// "#p" or "authors" specified -- we'll run this on the groups the user is in, see feeds.go
+			if s.MaxFeedGroups <= 0 {
+				return true, "blocked: queries across groups are disabled on this relay"
+			}
+			if authed == "" {
+				return true, "auth-required: queries across groups are only available to members"
+			}
+			return false, ""
 		} else {
 			// other tags are not supported (unless they come together with "h")
 			return true, "invalid query, must have 'h', 'e' or 'a' tag"
@@ -2,6 +2,8 @@ package relay29
 
 import (
 	"context"
+	"maps"
+	"slices"
 	"sync"
 	"sync/atomic"
 
@@ -13,8 +15,37 @@ type Group struct {
 	nip29.Group
 	mu sync.RWMutex
 
+	// see directory.go
+	Topics       []string
+	Language     string
+	createdAt    nostr.Timestamp
+	lastActivity atomic.Int64
+
 	last50      []string
 	last50index atomic.Int32
+
+	// used for ordering moderation events, see sequence.go
+	sequence       int64
+	lastModeration string
+
+	// cached, see version.go and metadata_cache.go
+	hash   atomic.Pointer[string]
+	signed [4]atomic.Pointer[nostr.Event]
+
+	// recent changes to the list of members, see members_delta.go
+	membershipChanges     []membershipChange
+	membershipChangesFrom int64
+	membersBroadcasted    atomic.Int64
+
+	// see admins.go
+	isAdminRole func(nip29.Group, *nip29.Role) bool
+
+	// where this group went, see migration.go
+	MovedTo   nip29.GroupAddress
+	exporting bool
+
+	// ids and timestamps of all the events, for NIP-77, see negentropy.go
+	negentropy negentropyIndex
 }
 
 // NewGroup creates a new group from scratch (but doesn't store it in the groups map)
@@ -28,7 +59,8 @@ func (s *State) NewGroup(id string, creator string) *Group {
 			Roles:   s.defaultRoles,
 			Members: make(map[string][]*nip29.Role, 12),
 		},
-		last50: make([]string, 50),
+		last50:      make([]string, 50),
+		isAdminRole: s.isAdminRole,
 	}
 
 	group.Members[creator] = []*nip29.Role{s.groupCreatorDefaultRole}
@@ -46,51 +78,115 @@ func (s *State) loadGroupsFromDB(ctx context.Context) error {
 		gtag := evt.Tags.GetFirst([]string{"h", ""})
 		id := (*gtag)[1]
 
-		group := s.NewGroup(id, evt.PubKey)
-		f := nostr.Filter{
-			Limit: 5000, Kinds: nip29.ModerationEventKinds, Tags: nostr.TagMap{"h": []string{id}},
-		}
-		ch, err := s.DB.QueryEvents(ctx, f)
+		events, sequence, err := s.moderationHistory(ctx, id)
 		if err != nil {
 			return err
 		}
 
-		events := make([]*nostr.Event, 0, 5000)
-		for event := range ch {
-			events = append(events, event)
-		}
-		for i := len(events) - 1; i >= 0; i-- {
-			evt := events[i]
-			act, err := PrepareModerationAction(evt)
-			if err != nil {
-				return err
-			}
-			act.Apply(&group.Group)
+		group, err := s.groupFromHistory(id, evt.PubKey, events, sequence)
+		if err != nil {
+			return err
 		}
 
 		// if the group was deleted there will be no actions after the delete
-		if len(events) > 0 && events[0].Kind == nostr.KindSimpleGroupDeleteGroup {
+		if len(events) > 0 && events[len(events)-1].Kind == nostr.KindSimpleGroupDeleteGroup {
 			// we don't keep track of this if it was deleted
 			continue
 		}
 
 		// load the last 50 event ids for "previous" tag checking
 		i := 49
-		ch, err = s.DB.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{id}}, Limit: 50})
+		ch, err := s.DB.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{id}}, Limit: 50})
 		if err != nil {
 			return err
 		}
 		for evt := range ch {
 			group.last50[i] = evt.ID
+			group.touchActivity(evt.CreatedAt)
 			i--
 		}
 
+		s.updateMemberships(group, slices.Collect(maps.Keys(group.Members)))
 		s.Groups.Store(group.Address.ID, group)
 	}
 
 	return nil
 }
 
+// groupFromHistory builds a group from its moderation events, sequence is the sequence of the group after them.
+func (s *State) groupFromHistory(id string, creator string, events []*nostr.Event, sequence int64) (*Group, error) {
+	group := s.NewGroup(id, creator)
+	if _, err := s.replayModerationEvents(group, events); err != nil {
+		return nil, err
+	}
+
+	group.sequence = sequence
+	group.membershipChangesFrom = group.sequence
+	group.membersBroadcasted.Store(group.sequence)
+	if len(events) > 0 {
+		group.lastModeration = events[len(events)-1].ID
+	}
+	return group, nil
+}
+
+// moderationHistory returns all the moderation events of a group in the order they were applied, along with the
+// sequence of the group after the last one.
+func (s *State) moderationHistory(ctx context.Context, groupId string) ([]*nostr.Event, int64, error) {
+	events := make([]*nostr.Event, 0, 100)
+	err := PageEvents(ctx, s.DB.QueryEvents, nostr.Filter{
+		Kinds: append(slices.Clone(ModerationEventKinds), KindSimpleGroupSequence),
+		Tags:  nostr.TagMap{"h": []string{groupId}},
+	}, func(evt *nostr.Event) {
+		events = append(events, evt)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events, sequence := sequenceModerationEvents(events, s.publicKey)
+	return events, sequence, nil
+}
+
+// replayModerationEvents applies the given moderation events, in order, to a group.
+// it returns the actions that were applied, with reverts already prepared.
+func (s *State) replayModerationEvents(group *Group, events []*nostr.Event) ([]Action, error) {
+	// reverts need to know the state of the group right before the event they're reverting
+	reverted := make(map[string]*Group)
+	for _, evt := range events {
+		if evt.Kind == KindSimpleGroupRevert {
+			if tag := evt.Tags.GetFirst([]string{"e", ""}); tag != nil {
+				reverted[(*tag)[1]] = nil
+			}
+		}
+	}
+
+	actions := make([]Action, len(events))
+	for i, evt := range events {
+		act, err := s.prepareModerationAction(evt)
+		if err != nil {
+			return nil, err
+		}
+
+		if revert, ok := act.(Revert); ok {
+			if before, ok := reverted[revert.Target]; ok && before != nil {
+				targetIdx := slices.IndexFunc(events[0:i], func(evt *nostr.Event) bool { return evt.ID == revert.Target })
+				revert.Undo = inverseOfSequence([]Action{actions[targetIdx]}, before, revert.When)
+				delete(reverted, revert.Target) // can only be reverted once
+			}
+			act = revert
+		}
+
+		if _, ok := reverted[evt.ID]; ok {
+			reverted[evt.ID] = group.snapshot()
+		}
+
+		actions[i] = act
+		group.applyAction(act)
+	}
+
+	return actions, nil
+}
+
 func (s *State) GetGroupFromEvent(event *nostr.Event) *Group {
 	group, _ := s.Groups.Load(GetGroupIDFromEvent(event))
 	return group
@@ -0,0 +1,228 @@
+package relay29
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// GroupAt rebuilds the state of a group as it was at the given time by replaying its moderation history
+// up to (and including) that moment.
+func (s *State) GroupAt(ctx context.Context, groupId string, at nostr.Timestamp) (*Group, error) {
+	return s.groupAsOf(ctx, groupId, func(evt *nostr.Event) bool { return evt.CreatedAt > at })
+}
+
+// GroupAtEvent rebuilds the state of a group as it was right after the moderation event with the given id
+// was applied.
+func (s *State) GroupAtEvent(ctx context.Context, groupId string, eventId string) (*Group, error) {
+	found := false
+	group, err := s.groupAsOf(ctx, groupId, func(evt *nostr.Event) bool {
+		if found {
+			return true
+		}
+		found = evt.ID == eventId
+		return false
+	})
+	if err == nil && !found {
+		return nil, fmt.Errorf("event %s is not part of the moderation history of group '%s'", eventId, groupId)
+	}
+	return group, err
+}
+
+// groupAsOf replays the moderation history of a group until stop() returns true.
+func (s *State) groupAsOf(ctx context.Context, groupId string, stop func(*nostr.Event) bool) (*Group, error) {
+	events, _, err := s.moderationHistory(ctx, groupId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load moderation history: %w", err)
+	}
+
+	if idx := slices.IndexFunc(events, stop); idx != -1 {
+		events = events[0:idx]
+	}
+	if len(events) == 0 || events[0].Kind != nostr.KindSimpleGroupCreateGroup {
+		return nil, fmt.Errorf("group '%s' didn't exist at that point", groupId)
+	}
+
+	group := s.NewGroup(groupId, events[0].PubKey)
+	if _, err := s.replayModerationEvents(group, events); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// HistoryStep is one moderation event from the history of a group, with what it did.
+type HistoryStep struct {
+	Event   *nostr.Event `json:"event"`
+	Action  Action       `json:"-"`
+	Changes GroupDiff    `json:"changes"`
+}
+
+// ModerationLog replays the whole moderation history of a group, oldest first, telling what each event changed.
+func (s *State) ModerationLog(ctx context.Context, groupId string) ([]HistoryStep, error) {
+	events, _, err := s.moderationHistory(ctx, groupId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load moderation history: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("group '%s' has no moderation history", groupId)
+	}
+
+	// this gives us the actions with the reverts already prepared
+	group := s.NewGroup(groupId, events[0].PubKey)
+	actions, err := s.replayModerationEvents(group, events)
+	if err != nil {
+		return nil, err
+	}
+
+	// then we do it again, but slowly
+	group = s.NewGroup(groupId, events[0].PubKey)
+	steps := make([]HistoryStep, len(events))
+	for i, action := range actions {
+		before := group.snapshot()
+		group.applyAction(action)
+		steps[i] = HistoryStep{Event: events[i], Action: action, Changes: DiffGroups(before, group)}
+	}
+
+	return steps, nil
+}
+
+// GroupDiff describes what changed in a group between two points in time.
+type GroupDiff struct {
+	MembersAdded    []string               `json:"members_added,omitempty"`
+	MembersRemoved  []string               `json:"members_removed,omitempty"`
+	RolesChanged    map[string]RolesChange `json:"roles_changed,omitempty"`
+	MetadataChanged map[string]ValueChange `json:"metadata_changed,omitempty"`
+}
+
+type RolesChange struct {
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+type ValueChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+func (diff GroupDiff) IsEmpty() bool {
+	return len(diff.MembersAdded) == 0 && len(diff.MembersRemoved) == 0 &&
+		len(diff.RolesChanged) == 0 && len(diff.MetadataChanged) == 0
+}
+
+// DiffGroups compares two states of a group.
+func DiffGroups(before, after *Group) GroupDiff {
+	diff := GroupDiff{
+		RolesChanged:    make(map[string]RolesChange),
+		MetadataChanged: make(map[string]ValueChange),
+	}
+
+	for pubkey, rolesAfter := range after.Members {
+		rolesBefore, wasMember := before.Members[pubkey]
+		if !wasMember {
+			diff.MembersAdded = append(diff.MembersAdded, pubkey)
+			continue
+		}
+		if namesBefore, namesAfter := RoleNames(rolesBefore), RoleNames(rolesAfter); !slices.Equal(namesBefore, namesAfter) {
+			diff.RolesChanged[pubkey] = RolesChange{Before: namesBefore, After: namesAfter}
+		}
+	}
+	for pubkey := range before.Members {
+		if _, isMember := after.Members[pubkey]; !isMember {
+			diff.MembersRemoved = append(diff.MembersRemoved, pubkey)
+		}
+	}
+	slices.Sort(diff.MembersAdded)
+	slices.Sort(diff.MembersRemoved)
+
+	for _, field := range []struct {
+		name          string
+		before, after string
+	}{
+		{"name", before.Name, after.Name},
+		{"about", before.About, after.About},
+		{"picture", before.Picture, after.Picture},
+		{"private", strconv.FormatBool(before.Private), strconv.FormatBool(after.Private)},
+		{"closed", strconv.FormatBool(before.Closed), strconv.FormatBool(after.Closed)},
+		{"topics", strings.Join(before.Topics, ","), strings.Join(after.Topics, ",")},
+		{"language", before.Language, after.Language},
+	} {
+		if field.before != field.after {
+			diff.MetadataChanged[field.name] = ValueChange{Before: field.before, After: field.after}
+		}
+	}
+
+	return diff
+}
+
+// RoleNames returns the sorted names of the given roles, skipping the ones that are nil.
+func RoleNames(roles []*nip29.Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		if role != nil {
+			names = append(names, role.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// groupAtPoint takes either a unix timestamp or a moderation event id.
+func (s *State) groupAtPoint(ctx context.Context, groupId string, point string) (*Group, error) {
+	if nostr.IsValid32ByteHex(point) {
+		return s.GroupAtEvent(ctx, groupId, point)
+	}
+	if ts, err := strconv.ParseInt(point, 10, 64); err == nil {
+		return s.GroupAt(ctx, groupId, nostr.Timestamp(ts))
+	}
+	return nil, fmt.Errorf("'%s' is neither a timestamp nor an event id", point)
+}
+
+// HistoryHandler answers questions about past states of a group over HTTP:
+//
+//	?group=<id>&at=<timestamp-or-event-id> returns the group as it was at that point;
+//	?group=<id>&from=<timestamp-or-event-id>&to=<timestamp-or-event-id> returns what changed between these points.
+//
+// This reveals everything about private groups, so it must only be mounted behind some form of authentication.
+func (s *State) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	groupId := r.URL.Query().Get("group")
+	if groupId == "" {
+		http.Error(w, "missing 'group'", 400)
+		return
+	}
+
+	var result any
+	if at := r.URL.Query().Get("at"); at != "" {
+		group, err := s.groupAtPoint(r.Context(), groupId, at)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		result = group
+	} else if from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to"); from != "" && to != "" {
+		before, err := s.groupAtPoint(r.Context(), groupId, from)
+		if err != nil {
+			http.Error(w, "from: "+err.Error(), 404)
+			return
+		}
+		after, err := s.groupAtPoint(r.Context(), groupId, to)
+		if err != nil {
+			http.Error(w, "to: "+err.Error(), 404)
+			return
+		}
+		result = DiffGroups(before, after)
+	} else {
+		http.Error(w, "must have either 'at' or 'from' and 'to'", 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,74 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupAt(t *testing.T) {
+	ctx := context.Background()
+
+	db := &MemoryStore{}
+	db.Init()
+
+	owner := &nip29.Role{Name: "owner"}
+	state := New(Options{
+		Domain:                  "localhost",
+		DB:                      db,
+		SecretKey:               nostr.GeneratePrivateKey(),
+		DefaultRoles:            []*nip29.Role{owner},
+		GroupCreatorDefaultRole: owner,
+	})
+
+	user1 := nostr.GeneratePrivateKey()
+	user1pk, _ := nostr.GetPublicKey(user1)
+	user2pk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	events := []*nostr.Event{
+		{CreatedAt: 10, Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "x"}}},
+		{CreatedAt: 20, Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "x"}, {"name", "first"}}},
+		{CreatedAt: 30, Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "x"}, {"p", user2pk}}},
+		{CreatedAt: 40, Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "x"}, {"name", "second"}}},
+		{CreatedAt: 50, Kind: nostr.KindSimpleGroupRemoveUser, Tags: nostr.Tags{{"h", "x"}, {"p", user2pk}}},
+	}
+	for _, evt := range events {
+		evt.Sign(user1)
+		require.NoError(t, db.SaveEvent(ctx, evt))
+	}
+
+	_, err := state.GroupAt(ctx, "x", 5)
+	require.Error(t, err, "group shouldn't exist before it was created")
+
+	at25, err := state.GroupAt(ctx, "x", 25)
+	require.NoError(t, err)
+	require.Equal(t, "first", at25.Name)
+	require.Len(t, at25.Members, 1)
+	require.Contains(t, at25.Members, user1pk)
+
+	at45, err := state.GroupAtEvent(ctx, "x", events[3].ID)
+	require.NoError(t, err)
+	require.Equal(t, "second", at45.Name)
+	require.Contains(t, at45.Members, user2pk)
+
+	diff := DiffGroups(at25, at45)
+	require.Equal(t, []string{user2pk}, diff.MembersAdded)
+	require.Equal(t, ValueChange{Before: "first", After: "second"}, diff.MetadataChanged["name"])
+
+	now, err := state.GroupAt(ctx, "x", nostr.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{user2pk}, DiffGroups(at45, now).MembersRemoved)
+	require.True(t, DiffGroups(now, now).IsEmpty())
+
+	steps, err := state.ModerationLog(ctx, "x")
+	require.NoError(t, err)
+	require.Len(t, steps, 5)
+	require.Equal(t, "create-group", steps[0].Action.Name())
+	require.True(t, steps[0].Changes.IsEmpty())
+	require.Equal(t, ValueChange{Before: "", After: "first"}, steps[1].Changes.MetadataChanged["name"])
+	require.Equal(t, []string{user2pk}, steps[2].Changes.MembersAdded)
+	require.Equal(t, []string{user2pk}, steps[4].Changes.MembersRemoved)
+}
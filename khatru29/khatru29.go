@@ -15,41 +15,29 @@ func Init(opts relay29.Options) (*khatru.Relay, *relay29.State) {
 	// create a new khatru relay
 	relay := khatru.NewRelay()
 	relay.Info.PubKey = pubkey
-	relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 29)
+	relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 29, 40, 45, 50)
+	relay.Negentropy = true
 
 	// assign khatru relay to relay29.State
 	state.Relay = relay
 
+	// identify ourselves in the audit log
+	state.Adapter = "khatru29"
+
 	// provide GetAuthed function
 	state.GetAuthed = khatru.GetAuthed
 
-	// apply basic relay policies
-	relay.StoreEvent = append(relay.StoreEvent, state.DB.SaveEvent)
-	relay.QueryEvents = append(relay.QueryEvents,
-		state.NormalEventQuery,
-		state.MetadataQueryHandler,
-		state.AdminsQueryHandler,
-		state.MembersQueryHandler,
-		state.RolesQueryHandler,
-	)
-	relay.DeleteEvent = append(relay.DeleteEvent, state.DB.DeleteEvent)
-	relay.RejectFilter = append(relay.RejectFilter,
-		state.RequireKindAndSingleGroupIDOrSpecificEventReference,
-	)
-	relay.RejectEvent = append(relay.RejectEvent,
-		state.RequireHTagForExistingGroup,
-		state.RequireModerationEventsToBeRecent,
-		state.RestrictWritesBasedOnGroupRules,
-		state.RestrictInvalidModerationActions,
-		state.PreventWritingOfEventsJustDeleted,
-		state.CheckPreviousTag,
-	)
-	relay.OnEventSaved = append(relay.OnEventSaved,
-		state.ApplyModerationAction,
-		state.ReactToJoinRequest,
-		state.ReactToLeaveRequest,
-		state.AddToPreviousChecking,
-	)
+	// everything goes through the relay29 pipeline
+	pipeline := state.Pipeline
+	relay.StoreEvent = append(relay.StoreEvent, pipeline.Store)
+	relay.QueryEvents = append(relay.QueryEvents, pipeline.Query)
+	relay.DeleteEvent = append(relay.DeleteEvent, pipeline.Delete)
+	relay.RejectFilter = append(relay.RejectFilter, pipeline.RejectQuery)
+	relay.CountEvents = append(relay.CountEvents, pipeline.Count)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, pipeline.RejectQuery)
+	relay.RejectEvent = append(relay.RejectEvent, pipeline.Reject)
+	relay.OnEventSaved = append(relay.OnEventSaved, pipeline.AfterSave)
+
 	relay.OnConnect = append(relay.OnConnect, khatru.RequestAuth)
 
 	return relay, state
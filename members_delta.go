@@ -0,0 +1,155 @@
+package relay29
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindSimpleGroupMembersDelta is a relay-signed event that lists only the members that were added to or removed
+// from a group since a given version, as ["p", <pubkey>] and ["removed", <pubkey>] tags. it is broadcasted
+// whenever the list of members changes and can be queried with
+// {"kinds": [9013], "#h": ["<group>"], "#v": ["<version the client has>"]}.
+//
+// it's a regular kind so relays and clients keep all the deltas, each one only makes sense after the ones before.
+//
+// when we don't have all the changes since the version asked for (or the version is "0") the event will have
+// ["from", "0"] and list all the current members, in which case clients should replace what they have with it.
+const KindSimpleGroupMembersDelta = 9013
+
+// how many membership changes we keep per group for computing deltas
+const membershipChangesKept = 5000
+
+type membershipChange struct {
+	version int64
+	pubkey  string
+}
+
+// membersTouchedBy returns the pubkeys whose membership may have been changed by an action.
+func membersTouchedBy(action Action) []string {
+	switch a := action.(type) {
+	case CreateGroup:
+		return []string{a.Creator}
+	case PutUser:
+		pubkeys := make([]string, len(a.Targets))
+		for i, target := range a.Targets {
+			pubkeys[i] = target.PubKey
+		}
+		return pubkeys
+	case RemoveUser:
+		return a.Targets
+	case Revert:
+		var pubkeys []string
+		for _, undo := range a.Undo {
+			pubkeys = append(pubkeys, membersTouchedBy(undo)...)
+		}
+		return pubkeys
+	}
+	return nil
+}
+
+// recordMembershipChanges must be called with the group lock held, right after the action was applied.
+func (group *Group) recordMembershipChanges(action Action) {
+	for _, pubkey := range membersTouchedBy(action) {
+		group.membershipChanges = append(group.membershipChanges, membershipChange{group.sequence, pubkey})
+	}
+
+	if excess := len(group.membershipChanges) - membershipChangesKept; excess > 0 {
+		// we can't answer for anything before the last change we're forgetting
+		group.membershipChangesFrom = group.membershipChanges[excess-1].version
+		group.membershipChanges = slices.Delete(group.membershipChanges, 0, excess)
+	}
+}
+
+// ToMembersDeltaEvent must be called with the group lock held (for reading, at least).
+func (group *Group) ToMembersDeltaEvent(from int64) *nostr.Event {
+	evt := &nostr.Event{
+		Kind:      KindSimpleGroupMembersDelta,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"h", group.Address.ID}},
+	}
+
+	if from <= 0 || from < group.membershipChangesFrom || from > group.sequence {
+		// we can't tell what changed, so everything changed
+		evt.Tags = append(evt.Tags, nostr.Tag{"from", "0"})
+		evt.Tags = slices.Grow(evt.Tags, len(group.Members)+2)
+		for pubkey := range group.Members {
+			evt.Tags = append(evt.Tags, nostr.Tag{"p", pubkey})
+		}
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"from", strconv.FormatInt(from, 10)})
+		start, _ := slices.BinarySearchFunc(group.membershipChanges, from+1,
+			func(change membershipChange, version int64) int { return cmp.Compare(change.version, version) })
+		seen := make(map[string]struct{}, len(group.membershipChanges)-start)
+		for _, change := range group.membershipChanges[start:] {
+			if _, ok := seen[change.pubkey]; ok {
+				continue
+			}
+			seen[change.pubkey] = struct{}{}
+
+			// only the current state matters
+			if _, isMember := group.Members[change.pubkey]; isMember {
+				evt.Tags = append(evt.Tags, nostr.Tag{"p", change.pubkey})
+			} else {
+				evt.Tags = append(evt.Tags, nostr.Tag{"removed", change.pubkey})
+			}
+		}
+	}
+
+	group.addVersionTags(evt)
+	return evt
+}
+
+func (s *State) MembersDeltaQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event, 1)
+
+	authed := s.GetAuthed(ctx)
+	go func() {
+		defer close(ch)
+
+		if !slices.Contains(filter.Kinds, KindSimpleGroupMembersDelta) {
+			return
+		}
+
+		froms := filter.Tags["v"]
+		if len(froms) == 0 {
+			froms = []string{"0"}
+		}
+
+		for _, groupId := range filter.Tags["h"] {
+			group, _ := s.Groups.Load(groupId)
+			if group == nil {
+				continue
+			}
+
+			group.mu.RLock()
+			if group.Private {
+				// don't reveal lists of members of private groups unless we're a member
+				if _, isMember := group.Members[authed]; authed == "" || !isMember {
+					group.mu.RUnlock()
+					continue
+				}
+			}
+			events := make([]*nostr.Event, 0, len(froms))
+			for _, from := range froms {
+				version, _ := strconv.ParseInt(from, 10, 64)
+				events = append(events, group.ToMembersDeltaEvent(version))
+			}
+			group.mu.RUnlock()
+
+			for _, evt := range events {
+				evt.Sign(s.secretKey)
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,78 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembersDelta(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	user1, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	user2, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	user3, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	require.NoError(t, state.CreateGroup(ctx, "m", owner, EditMetadata{}))
+	require.NoError(t, state.PutUser(ctx, "m", user1))
+	require.NoError(t, state.PutUser(ctx, "m", user2))
+
+	group, _ := state.Groups.Load("m")
+	require.Equal(t, int64(3), group.Sequence())
+
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "m", user1))
+	require.NoError(t, state.PutUser(ctx, "m", user3))
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "m", user3))
+	require.NoError(t, state.PutUser(ctx, "m", user2, "moderator"))
+
+	query := func(from string) *nostr.Event {
+		ch, err := state.MembersDeltaQueryHandler(ctx, nostr.Filter{
+			Kinds: []int{KindSimpleGroupMembersDelta},
+			Tags:  nostr.TagMap{"h": []string{"m"}, "v": []string{from}},
+		})
+		require.NoError(t, err)
+		evt := <-ch
+		require.NotNil(t, evt)
+		require.True(t, evt.CheckID())
+		return evt
+	}
+
+	// only what changed since the version we know
+	delta := query("3")
+	require.Equal(t, "3", delta.Tags.GetFirst([]string{"from", ""}).Value())
+	require.Equal(t, "7", delta.Tags.GetFirst([]string{"version", ""}).Value())
+	require.NotNil(t, delta.Tags.GetFirst([]string{"removed", user1}))
+	require.NotNil(t, delta.Tags.GetFirst([]string{"removed", user3}))
+	require.NotNil(t, delta.Tags.GetFirst([]string{"p", user2}))
+	require.Nil(t, delta.Tags.GetFirst([]string{"p", owner}))
+
+	// or everything when we don't know anything
+	full := query("0")
+	require.Equal(t, "0", full.Tags.GetFirst([]string{"from", ""}).Value())
+	require.Len(t, full.Tags.GetAll([]string{"p", ""}), 2)
+	require.Nil(t, full.Tags.GetFirst([]string{"removed", ""}))
+
+	// after a restart we only know the changes that happen from then on
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+	})
+	restarted.GetAuthed = state.GetAuthed
+	state = restarted
+	require.Equal(t, "0", query("3").Tags.GetFirst([]string{"from", ""}).Value())
+	require.Equal(t, "7", query("7").Tags.GetFirst([]string{"from", ""}).Value())
+
+	// every delta is kept, and only we make them
+	require.True(t, nostr.IsRegularKind(KindSimpleGroupMembersDelta))
+	forged := &nostr.Event{CreatedAt: nostr.Now(), Kind: KindSimpleGroupMembersDelta, Tags: nostr.Tags{{"h", "m"}, {"removed", owner}}}
+	forged.Sign(nostr.GeneratePrivateKey())
+	reject, _ := state.RestrictWritesBasedOnGroupRules(ctx, forged)
+	require.True(t, reject)
+}
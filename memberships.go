@@ -0,0 +1,72 @@
+package relay29
+
+import (
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// membershipIndex is the reverse of group.Members: it tells the groups each pubkey is in, with their roles.
+type membershipIndex struct {
+	mu     sync.RWMutex
+	groups map[string]map[string][]*nip29.Role
+}
+
+func (idx *membershipIndex) set(groupId string, pubkey string, roles []*nip29.Role, isMember bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !isMember {
+		delete(idx.groups[pubkey], groupId)
+		if len(idx.groups[pubkey]) == 0 {
+			delete(idx.groups, pubkey)
+		}
+		return
+	}
+
+	if idx.groups[pubkey] == nil {
+		idx.groups[pubkey] = make(map[string][]*nip29.Role, 1)
+	}
+	idx.groups[pubkey][groupId] = roles
+}
+
+// updateMemberships must be called with the group lock held, after the membership of the given pubkeys changed.
+func (s *State) updateMemberships(group *Group, pubkeys []string) {
+	for _, pubkey := range pubkeys {
+		roles, isMember := group.Members[pubkey]
+		s.memberships.set(group.Address.ID, pubkey, roles, isMember)
+	}
+}
+
+// Memberships returns the ids of the groups a pubkey is a member of, with the roles it has in each.
+func (s *State) Memberships(pubkey string) map[string][]*nip29.Role {
+	s.memberships.mu.RLock()
+	defer s.memberships.mu.RUnlock()
+
+	result := make(map[string][]*nip29.Role, len(s.memberships.groups[pubkey]))
+	for groupId, roles := range s.memberships.groups[pubkey] {
+		result[groupId] = roles
+	}
+	return result
+}
+
+// groupsWith iterates over the groups that have at least one of the given pubkeys as members.
+func (s *State) groupsWith(pubkeys []string) func(yield func(string, *Group) bool) {
+	return func(yield func(string, *Group) bool) {
+		seen := make(map[string]struct{}, len(pubkeys))
+		for _, pubkey := range pubkeys {
+			for groupId := range s.Memberships(pubkey) {
+				if _, ok := seen[groupId]; ok {
+					continue
+				}
+				seen[groupId] = struct{}{}
+
+				if group, _ := s.Groups.Load(groupId); group != nil {
+					if !yield(groupId, group) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package relay29
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMyGroups(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	me, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	stranger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	yes, no := true, false
+	require.NoError(t, state.CreateGroup(ctx, "public", owner, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "private", owner, EditMetadata{PrivateValue: &yes, ClosedValue: &yes}))
+	require.NoError(t, state.CreateGroup(ctx, "closed", owner, EditMetadata{PrivateValue: &no, ClosedValue: &yes}))
+	require.NoError(t, state.CreateGroup(ctx, "other", owner, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "left", owner, EditMetadata{}))
+	for _, id := range []string{"public", "private", "closed", "left"} {
+		require.NoError(t, state.PutUser(ctx, id, me))
+	}
+	require.NoError(t, state.PutUser(ctx, "private", me, "moderator"))
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "left", me))
+
+	require.Len(t, state.Memberships(me), 3)
+	require.Equal(t, "moderator", state.Memberships(me)["private"][0].Name)
+	require.Len(t, state.Memberships(owner), 5)
+
+	query := func(authed string) []string {
+		state.GetAuthed = func(context.Context) string { return authed }
+		ch, err := state.MetadataQueryHandler(ctx, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata}, Tags: nostr.TagMap{"p": []string{me}}})
+		require.NoError(t, err)
+		ids := make([]string, 0, 3)
+		for evt := range ch {
+			ids = append(ids, evt.Tags.GetD())
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	// I can see all my groups
+	require.Equal(t, []string{"closed", "private", "public"}, query(me))
+
+	// others can only see the ones that would be listed anyway
+	require.Equal(t, []string{"public"}, query(stranger))
+	require.Equal(t, []string{"public"}, query(""))
+
+	// and the index survives a restart
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+	})
+	require.Equal(t, state.Memberships(me), restarted.Memberships(me))
+}
@@ -0,0 +1,95 @@
+package relay29
+
+import (
+	"context"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MemoryStore is an eventstore that only keeps things in memory, mostly useful for testing. unlike a plain
+// slicestore.SliceStore it can be used from many goroutines at the same time, which the relay always does (there are
+// many connections, and things like expiration run in the background).
+type MemoryStore struct {
+	mu    sync.RWMutex
+	store slicestore.SliceStore
+
+	// MaxLimit is the most events a query can return, 500 if not set
+	MaxLimit int
+}
+
+var (
+	_ eventstore.Store   = (*MemoryStore)(nil)
+	_ eventstore.Counter = (*MemoryStore)(nil)
+)
+
+func (ms *MemoryStore) Init() error {
+	ms.store.MaxLimit = ms.MaxLimit
+	return ms.store.Init()
+}
+
+func (ms *MemoryStore) Close() {}
+
+func (ms *MemoryStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// the slicestore stops right before the first event at since, so we ask for a second earlier and it stops at the
+	// right place instead
+	if filter.Since != nil && *filter.Since > 0 {
+		since := *filter.Since
+		sliced := filter
+		sliced.Since = &since
+		*sliced.Since--
+		filter = sliced
+	}
+
+	// the slicestore keeps reading after it returns, so everything must be read before we let go of the lock
+	res, err := ms.store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*nostr.Event, 0, 50)
+	for evt := range res {
+		events = append(events, evt)
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, evt := range events {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (ms *MemoryStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.store.CountEvents(ctx, filter)
+}
+
+func (ms *MemoryStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.store.SaveEvent(ctx, evt)
+}
+
+func (ms *MemoryStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.store.DeleteEvent(ctx, evt)
+}
+
+func (ms *MemoryStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.store.ReplaceEvent(ctx, evt)
+}
@@ -0,0 +1,69 @@
+package relay29
+
+import (
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the signed 39000-39003 events of each group are cached until the next moderation event is applied to the
+// group, and the same events are used for answering queries and for broadcasting.
+
+type metadataCacheCounters struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type MetadataCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// MetadataCacheStats tells how many times the signed metadata events we needed were in the cache and how many
+// times we had to build and sign them.
+func (s *State) MetadataCacheStats() MetadataCacheStats {
+	return MetadataCacheStats{
+		Hits:   s.metadataCache.hits.Load(),
+		Misses: s.metadataCache.misses.Load(),
+	}
+}
+
+// signedMetadataEvent returns the signed metadata event of the given kind (39000-39003) for a group.
+// it must be called with the group lock held (for reading, at least).
+func (s *State) signedMetadataEvent(group *Group, kind int) *nostr.Event {
+	slot := &group.signed[kind-nostr.KindSimpleGroupMetadata]
+	if evt := slot.Load(); evt != nil {
+		s.metadataCache.hits.Add(1)
+		return evt
+	}
+	s.metadataCache.misses.Add(1)
+
+	var evt *nostr.Event
+	switch kind {
+	case nostr.KindSimpleGroupMetadata:
+		evt = group.ToMetadataEvent()
+	case nostr.KindSimpleGroupAdmins:
+		evt = group.ToAdminsEvent()
+	case nostr.KindSimpleGroupMembers:
+		evt = group.ToMembersEvent()
+	case nostr.KindSimpleGroupRoles:
+		evt = group.ToRolesEvent()
+	}
+	evt.Sign(s.secretKey)
+
+	// if someone else got here first it doesn't matter, the events are equivalent
+	slot.Store(evt)
+	return evt
+}
+
+// invalidateCaches must be called with the group lock held, whenever the group changes.
+//
+// all four events are dropped even when only some of the fields they show changed (like the members, or nothing at
+// all for a delete-event): each of them carries the "version" and "hash" tags (see version.go), which change with
+// every moderation event, so keeping any of them would give clients a version that isn't the current one.
+func (group *Group) invalidateCaches() {
+	group.hash.Store(nil)
+	for i := range group.signed {
+		group.signed[i].Store(nil)
+	}
+}
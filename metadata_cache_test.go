@@ -0,0 +1,81 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataCache(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	var broadcasted []*nostr.Event
+	state.Relay = recordingRelay{testRelay{state}, &broadcasted}
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	name := "cached"
+	require.NoError(t, state.CreateGroup(ctx, "c", owner, EditMetadata{NameValue: &name}))
+
+	query := func() *nostr.Event {
+		ch, err := state.MembersQueryHandler(ctx, nostr.Filter{
+			Kinds: []int{nostr.KindSimpleGroupMembers},
+			Tags:  nostr.TagMap{"d": []string{"c"}},
+		})
+		require.NoError(t, err)
+		return <-ch
+	}
+
+	// the event we broadcasted is the same we return for queries
+	var members *nostr.Event
+	for _, evt := range broadcasted {
+		if evt.Kind == nostr.KindSimpleGroupMembers {
+			members = evt
+		}
+	}
+	require.NotNil(t, members)
+	before := state.MetadataCacheStats()
+	require.Same(t, members, query())
+	require.Same(t, members, query())
+	require.Equal(t, before.Hits+2, state.MetadataCacheStats().Hits)
+	require.Equal(t, before.Misses, state.MetadataCacheStats().Misses)
+
+	// until something changes
+	require.NoError(t, state.PutUser(ctx, "c", member))
+	changed := query()
+	require.NotSame(t, members, changed)
+	require.True(t, changed.CheckID())
+	ok, _ := changed.CheckSignature()
+	require.True(t, ok)
+	require.NotNil(t, changed.Tags.GetFirst([]string{"p", member}))
+}
+
+func TestMetadataCacheFollowsVersion(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	require.NoError(t, state.CreateGroup(ctx, "c", owner, EditMetadata{}))
+	group, _ := state.Groups.Load("c")
+
+	signed := func() []*nostr.Event {
+		group.mu.RLock()
+		defer group.mu.RUnlock()
+		events := make([]*nostr.Event, 0, 4)
+		for kind := nostr.KindSimpleGroupMetadata; kind <= nostr.KindSimpleGroupRoles; kind++ {
+			events = append(events, state.signedMetadataEvent(group, kind))
+		}
+		return events
+	}
+
+	// deleting an event changes none of the fields, but all the events get the new version
+	before := signed()
+	require.NoError(t, state.DeleteEvent(ctx, "c", "0000000000000000000000000000000000000000000000000000000000000000"))
+	for i, evt := range signed() {
+		require.NotSame(t, before[i], evt)
+		require.Equal(t, "2", evt.Tags.GetFirst([]string{"version", ""}).Value())
+	}
+}
@@ -0,0 +1,278 @@
+package relay29
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// groups can be moved to another relay: ExportGroup gives a bundle with everything the group has and marks the group
+// as moved (with a KindSimpleGroupMoved moderation event signed by the relay, which makes the group metadata get a
+// ["moved", <relay>, <id>] tag and stops accepting writes), then ImportGroup on the new relay checks the bundle and
+// recreates the group from it.
+//
+// the moved event is also what proves the bundle came from the old relay, its "bundle" tag has a hash of everything
+// else.
+
+type MigrationBundle struct {
+	Moved      *nostr.Event   `json:"moved"`
+	Snapshot   []*nostr.Event `json:"snapshot"`
+	Moderation []*nostr.Event `json:"moderation"`
+	Content    []*nostr.Event `json:"content"`
+}
+
+func (bundle MigrationBundle) hash() string {
+	data, _ := json.Marshal([][]*nostr.Event{bundle.Snapshot, bundle.Moderation, bundle.Content})
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// Verify checks that the bundle was made by the relay with the given pubkey and wasn't tampered with.
+func (bundle MigrationBundle) Verify(relayPubKey string) error {
+	moved := bundle.Moved
+	if moved == nil || moved.Kind != KindSimpleGroupMoved {
+		return fmt.Errorf("missing moved event")
+	}
+	if moved.PubKey != relayPubKey {
+		return fmt.Errorf("bundle was made by %s, not by %s", moved.PubKey, relayPubKey)
+	}
+	if ok, _ := moved.CheckSignature(); !ok {
+		return fmt.Errorf("invalid signature on moved event")
+	}
+	if tag := moved.Tags.GetFirst([]string{"bundle", ""}); tag == nil || (*tag)[1] != bundle.hash() {
+		return fmt.Errorf("bundle contents don't match the moved event")
+	}
+	return nil
+}
+
+// ExportGroup gets everything from a group and marks it as moved to another relay, under the given id there.
+func (s *State) ExportGroup(ctx context.Context, groupId string, relay string, newGroupId string) (*MigrationBundle, error) {
+	s.catchUp(ctx, groupId)
+
+	if newGroupId == "" {
+		newGroupId = groupId
+	}
+
+	bundle := &MigrationBundle{
+		Snapshot: make([]*nostr.Event, 0, 4),
+		Content:  make([]*nostr.Event, 0, 500),
+	}
+
+	// the moderation history is taken while no moderation events can be applied
+	s.moderationMu.Lock()
+	group, _ := s.Groups.Load(groupId)
+	if group == nil {
+		s.moderationMu.Unlock()
+		return nil, fmt.Errorf("group '%s' doesn't exist", groupId)
+	}
+
+	// and from now on no other events are accepted
+	group.mu.Lock()
+	movedTo, exporting := group.MovedTo, group.exporting
+	group.exporting = true
+	group.mu.Unlock()
+	if movedTo.Relay != "" {
+		s.moderationMu.Unlock()
+		return nil, fmt.Errorf("group '%s' has already moved to %s", groupId, movedTo.Relay)
+	}
+	if exporting {
+		s.moderationMu.Unlock()
+		return nil, fmt.Errorf("group '%s' is already being exported", groupId)
+	}
+	defer func() {
+		group.mu.Lock()
+		group.exporting = false
+		group.mu.Unlock()
+	}()
+
+	var sequence int64
+	var err error
+	bundle.Moderation, sequence, err = s.moderationHistory(ctx, groupId)
+	if err != nil {
+		s.moderationMu.Unlock()
+		return nil, fmt.Errorf("failed to load moderation history: %w", err)
+	}
+	group.mu.RLock()
+	for _, kind := range nip29.MetadataEventKinds {
+		bundle.Snapshot = append(bundle.Snapshot, s.signedMetadataEvent(group, kind))
+	}
+	group.mu.RUnlock()
+	s.moderationMu.Unlock()
+
+	// the content can take a while, but the group isn't accepting anything so other groups don't have to wait
+	s.eachGroupEvent(ctx, groupId, func(evt *nostr.Event) {
+		if !ModerationEventKinds.Includes(evt.Kind) && evt.Kind != KindSimpleGroupSequence {
+			bundle.Content = append(bundle.Content, evt)
+		}
+	})
+	slices.Reverse(bundle.Content) // oldest first
+
+	s.moderationMu.Lock()
+	defer s.moderationMu.Unlock()
+
+	// the relay itself may have changed something in the meantime
+	if group.Sequence() != sequence {
+		return nil, fmt.Errorf("group '%s' changed while it was being exported", groupId)
+	}
+
+	bundle.Moved = &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      KindSimpleGroupMoved,
+		Tags: nostr.Tags{
+			{"h", groupId},
+			{"moved", relay, newGroupId},
+			{"bundle", bundle.hash()},
+		},
+	}
+	if err := s.applyEventsLocked(ctx, bundle.Moved); err != nil {
+		return nil, fmt.Errorf("failed to mark group as moved: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// ImportGroup recreates a group exported from the relay with the given pubkey. if newGroupId is empty the id
+// given when exporting is used.
+//
+// when the id stays the same all the events are stored as they were and the moderation events are given numbers in
+// our sequence in the order of the bundle (the ones the old relay gave don't count here). otherwise the group is
+// recreated with moderation events signed by this relay, which only works for groups without content, as that is
+// signed with the old id. it returns the number of events that were imported.
+func (s *State) ImportGroup(ctx context.Context, bundle MigrationBundle, oldRelayPubKey string, newGroupId string) (int, error) {
+	if err := bundle.Verify(oldRelayPubKey); err != nil {
+		return 0, err
+	}
+	if len(bundle.Moderation) == 0 {
+		return 0, fmt.Errorf("bundle has no moderation events")
+	}
+
+	oldGroupId := GetGroupIDFromEvent(bundle.Moved)
+	if newGroupId == "" {
+		newGroupId = (*bundle.Moved.Tags.GetFirst([]string{"moved", ""}))[2]
+	}
+	if group, _ := s.Groups.Load(newGroupId); group != nil {
+		return 0, fmt.Errorf("group '%s' already exists here", newGroupId)
+	}
+	if newGroupId != oldGroupId && len(bundle.Content) > 0 {
+		return 0, fmt.Errorf("the content of group '%s' can't be moved to a different id", oldGroupId)
+	}
+
+	// replaying the history must give what the old relay had
+	creator := bundle.Moderation[0].PubKey
+	scratch, err := s.groupFromHistory(oldGroupId, creator, bundle.Moderation, int64(len(bundle.Moderation)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay moderation history: %w", err)
+	}
+	if err := checkSnapshot(scratch, bundle.Snapshot); err != nil {
+		return 0, err
+	}
+
+	if newGroupId == oldGroupId {
+		count := 0
+		for _, evt := range append(slices.Clone(bundle.Moderation), bundle.Content...) {
+			if GetGroupIDFromEvent(evt) != oldGroupId {
+				return count, fmt.Errorf("event %s doesn't belong to the group", evt.ID)
+			}
+			if evt.GetID() != evt.ID {
+				return count, fmt.Errorf("event %s has an invalid id", evt.ID)
+			}
+			if !ModerationEventKinds.Includes(evt.Kind) {
+				// moderation events are vouched for by the old relay, some of them it didn't even sign
+				if ok, _ := evt.CheckSignature(); !ok {
+					return count, fmt.Errorf("event %s has an invalid signature", evt.ID)
+				}
+			}
+			if err := s.DB.SaveEvent(ctx, evt); err != nil && err != eventstore.ErrDupEvent {
+				return count, fmt.Errorf("failed to store %s: %w", evt.ID, err)
+			}
+			count++
+		}
+
+		s.moderationMu.Lock()
+		for i, evt := range bundle.Moderation {
+			s.storeSequenceEvent(ctx, evt, int64(i+1))
+		}
+		s.resyncGroup(ctx, newGroupId)
+		s.moderationMu.Unlock()
+
+		for _, evt := range bundle.Content {
+			s.AddToPreviousChecking(ctx, evt)
+			s.ScheduleExpiration(ctx, evt)
+			s.IndexForSearch(ctx, evt)
+		}
+		return count, nil
+	}
+
+	// under a new id we recreate the current state with our own events, all at once
+	name, about, picture := scratch.Name, scratch.About, scratch.Picture
+	topics, language := scratch.Topics, scratch.Language
+	events := createGroupEvents(newGroupId, creator, EditMetadata{
+		NameValue:     &name,
+		AboutValue:    &about,
+		PictureValue:  &picture,
+		PrivateValue:  &scratch.Private,
+		ClosedValue:   &scratch.Closed,
+		TopicsValue:   &topics,
+		LanguageValue: &language,
+	})
+	if _, isMember := scratch.Members[creator]; !isMember {
+		// the creator may have left (but creating the group puts them back)
+		events = append(events, &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindSimpleGroupRemoveUser,
+			Tags:      nostr.Tags{{"h", newGroupId}, {"p", creator}},
+		})
+	}
+	for _, pubkey := range slices.Sorted(maps.Keys(scratch.Members)) {
+		roles := scratch.Members[pubkey]
+		if pubkey == creator && len(roles) == 1 && roles[0] == s.groupCreatorDefaultRole {
+			continue
+		}
+		events = append(events, &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindSimpleGroupPutUser,
+			Tags:      nostr.Tags{{"h", newGroupId}, append(nostr.Tag{"p", pubkey}, RoleNames(roles)...)},
+		})
+	}
+
+	if err := s.applyEvents(ctx, events...); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// checkSnapshot compares what we got from replaying the history with the metadata events the old relay signed.
+func checkSnapshot(group *Group, snapshot []*nostr.Event) error {
+	for _, evt := range snapshot {
+		switch evt.Kind {
+		case nostr.KindSimpleGroupMetadata:
+			if tag := evt.Tags.GetFirst([]string{"version", ""}); tag != nil {
+				if version, _ := strconv.ParseInt((*tag)[1], 10, 64); version != group.sequence {
+					return fmt.Errorf("snapshot is at version %d, history gives %d", version, group.sequence)
+				}
+			}
+			if tag := evt.Tags.GetFirst([]string{"name", ""}); tag != nil && (*tag)[1] != group.Name {
+				return fmt.Errorf("snapshot name is '%s', history gives '%s'", (*tag)[1], group.Name)
+			}
+		case nostr.KindSimpleGroupMembers:
+			members := make([]string, 0, len(evt.Tags))
+			for _, tag := range evt.Tags.GetAll([]string{"p", ""}) {
+				members = append(members, tag[1])
+			}
+			slices.Sort(members)
+			if !slices.Equal(members, slices.Sorted(maps.Keys(group.Members))) {
+				return fmt.Errorf("snapshot members don't match the history")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package relay29
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigration(t *testing.T) {
+	ctx := context.Background()
+	old := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	memberPk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	plainPk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	now := nostr.Now() - 100
+	publish := func(signer string, evt *nostr.Event) error {
+		now++
+		evt.CreatedAt = now
+		evt.Sign(signer)
+		_, err := old.Relay.AddEvent(ctx, evt)
+		return err
+	}
+
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "g"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "g"}, {"name", "travelers"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", memberPk, "moderator"}, {"p", plainPk}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: 9, Content: "one", Tags: nostr.Tags{{"h", "g"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: 9, Content: "two", Tags: nostr.Tags{{"h", "g"}}}))
+
+	bundle, err := old.ExportGroup(ctx, "g", "wss://new.example.com", "")
+	require.NoError(t, err)
+	require.Len(t, bundle.Moderation, 3)
+	require.Len(t, bundle.Content, 2)
+	require.Equal(t, "one", bundle.Content[0].Content)
+
+	// the old group now points to the new place and doesn't accept anything else
+	metadata, _ := old.Groups.Load("g")
+	require.Equal(t, "wss://new.example.com", metadata.MovedTo.Relay)
+	require.Contains(t, metadata.ToMetadataEvent().Tags, nostr.Tag{"moved", "wss://new.example.com", "g"})
+	require.Error(t, publish(owner, &nostr.Event{Kind: 9, Content: "three", Tags: nostr.Tags{{"h", "g"}}}))
+	_, err = old.ExportGroup(ctx, "g", "wss://other.example.com", "")
+	require.Error(t, err)
+
+	// bundles survive being serialized
+	data, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	var received MigrationBundle
+	require.NoError(t, json.Unmarshal(data, &received))
+
+	// same id, everything comes along
+	same := newTestState()
+	_, err = same.ImportGroup(ctx, received, ownerPk, "")
+	require.ErrorContains(t, err, "not by")
+	n, err := same.ImportGroup(ctx, received, old.publicKey, "")
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	group, _ := same.Groups.Load("g")
+	require.Equal(t, "travelers", group.Name)
+	require.Equal(t, "moderator", group.Members[memberPk][0].Name)
+	require.Equal(t, "owner", group.Members[ownerPk][0].Name)
+	require.Empty(t, group.MovedTo.Relay)
+	res, _ := same.DB.QueryEvents(ctx, nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": {"g"}}})
+	count := 0
+	for range res {
+		count++
+	}
+	require.Equal(t, 2, count)
+
+	// the moderation events are in our own sequence, in the order they had
+	history, sequence, err := same.moderationHistory(ctx, "g")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), sequence)
+	require.Equal(t, int64(3), group.Sequence())
+	for i, evt := range history {
+		require.Equal(t, bundle.Moderation[i].ID, evt.ID)
+	}
+
+	// new id, only for groups without content
+	_, err = newTestState().ImportGroup(ctx, received, old.publicKey, "h")
+	require.ErrorContains(t, err, "content")
+
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "q"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "q"}, {"name", "travelers"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "q"}, {"p", memberPk, "moderator"}, {"p", plainPk}}}))
+	quiet, err := old.ExportGroup(ctx, "q", "wss://new.example.com", "h")
+	require.NoError(t, err)
+	require.Empty(t, quiet.Content)
+
+	renamed := newTestState()
+	_, err = renamed.ImportGroup(ctx, *quiet, old.publicKey, "")
+	require.NoError(t, err)
+	group, _ = renamed.Groups.Load("h")
+	require.Equal(t, "travelers", group.Name)
+	require.Equal(t, "moderator", group.Members[memberPk][0].Name)
+	require.Equal(t, "owner", group.Members[ownerPk][0].Name)
+	require.Contains(t, group.Members, plainPk)
+	require.Empty(t, group.Members[plainPk])
+	require.Len(t, group.Members, 3)
+
+	// tampering is caught
+	received.Content = received.Content[1:]
+	_, err = newTestState().ImportGroup(ctx, received, old.publicKey, "")
+	require.ErrorContains(t, err, "don't match")
+}
@@ -10,19 +10,47 @@ import (
 
 var PTagNotValidPublicKey = fmt.Errorf("'p' tag value is not a valid public key")
 
+// KindSimpleGroupRevert is a moderation event that undoes a previous moderation event, referenced by an "e" tag
+const KindSimpleGroupRevert = 9010
+
+// KindSimpleGroupMoved is a moderation event that only the relay can publish, saying the group now lives somewhere
+// else, see migration.go
+const KindSimpleGroupMoved = 9011
+
+// ModerationEventKinds are the NIP-29 moderation event kinds plus the ones we add on top of them
+var ModerationEventKinds = append(slices.Clone(nip29.ModerationEventKinds), KindSimpleGroupRevert, KindSimpleGroupMoved)
+
 type Action interface {
 	Apply(group *nip29.Group)
 	Name() string
 }
 
+// ReversibleAction is an Action that can be undone with a revert moderation event.
+type ReversibleAction interface {
+	Action
+
+	// Inverse returns the actions that undo this one given the state of the group right before it was applied
+	Inverse(before *Group, when nostr.Timestamp) []Action
+}
+
 var (
 	_ Action = PutUser{}
 	_ Action = RemoveUser{}
 	_ Action = CreateGroup{}
 	_ Action = DeleteEvent{}
 	_ Action = EditMetadata{}
+	_ Action = MoveGroup{}
+
+	_ ReversibleAction = PutUser{}
+	_ ReversibleAction = RemoveUser{}
+	_ ReversibleAction = EditMetadata{}
+	_ ReversibleAction = Revert{}
 )
 
+// errMissingMetadata is what we get from an edit-metadata event that doesn't have any metadata, only the relay can
+// send those (see State.prepareModerationAction).
+var errMissingMetadata = fmt.Errorf("missing metadata tags")
+
 func PrepareModerationAction(evt *nostr.Event) (Action, error) {
 	factory, ok := moderationActionFactories[evt.Kind]
 	if !ok {
@@ -31,6 +59,16 @@ func PrepareModerationAction(evt *nostr.Event) (Action, error) {
 	return factory(evt)
 }
 
+// prepareModerationAction is PrepareModerationAction except that it takes edit-metadata events without any metadata
+// if they are ours, as we send one of those when a group is created without metadata (they don't change anything).
+func (s *State) prepareModerationAction(evt *nostr.Event) (Action, error) {
+	action, err := PrepareModerationAction(evt)
+	if err == errMissingMetadata && evt.PubKey == s.publicKey {
+		return EditMetadata{When: evt.CreatedAt}, nil
+	}
+	return action, err
+}
+
 var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 	nostr.KindSimpleGroupPutUser: func(evt *nostr.Event) (Action, error) {
 		targets := make([]PubKeyRoles, 0, len(evt.Tags))
@@ -96,10 +134,26 @@ var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 			ok = true
 		}
 
+		// topics are all replaced at once, an empty "t" tag clears them
+		if tags := evt.Tags.GetAll([]string{"t"}); len(tags) > 0 {
+			topics := make([]string, 0, len(tags))
+			for _, tag := range tags {
+				if len(tag) >= 2 && tag[1] != "" && !slices.Contains(topics, tag[1]) {
+					topics = append(topics, tag[1])
+				}
+			}
+			edit.TopicsValue = &topics
+			ok = true
+		}
+		if t := evt.Tags.GetFirst([]string{"l", ""}); t != nil {
+			edit.LanguageValue = &(*t)[1]
+			ok = true
+		}
+
 		if ok {
 			return edit, nil
 		}
-		return nil, fmt.Errorf("missing metadata tags")
+		return nil, errMissingMetadata
 	},
 	nostr.KindSimpleGroupDeleteEvent: func(evt *nostr.Event) (Action, error) {
 		tags := evt.Tags.GetAll([]string{"e", ""})
@@ -124,6 +178,25 @@ var moderationActionFactories = map[int]func(*nostr.Event) (Action, error){
 	nostr.KindSimpleGroupDeleteGroup: func(evt *nostr.Event) (Action, error) {
 		return DeleteGroup{When: evt.CreatedAt}, nil
 	},
+	KindSimpleGroupMoved: func(evt *nostr.Event) (Action, error) {
+		tag := evt.Tags.GetFirst([]string{"moved", ""})
+		if tag == nil || len(*tag) < 3 {
+			return nil, fmt.Errorf("missing 'moved' tag with relay and group id")
+		}
+		return MoveGroup{To: nip29.GroupAddress{Relay: (*tag)[1], ID: (*tag)[2]}, When: evt.CreatedAt}, nil
+	},
+	KindSimpleGroupRevert: func(evt *nostr.Event) (Action, error) {
+		tag := evt.Tags.GetFirst([]string{"e", ""})
+		if tag == nil {
+			return nil, fmt.Errorf("missing 'e' tag")
+		}
+		if !nostr.IsValid32ByteHex((*tag)[1]) {
+			return nil, fmt.Errorf("invalid event id hex")
+		}
+
+		// the actions that will actually undo the target are only known once we look at the group history
+		return Revert{Target: (*tag)[1], When: evt.CreatedAt}, nil
+	},
 }
 
 type DeleteEvent struct {
@@ -157,6 +230,19 @@ func (a PutUser) Apply(group *nip29.Group) {
 	}
 }
 
+func (a PutUser) Inverse(before *Group, when nostr.Timestamp) []Action {
+	restore := PutUser{When: when}
+	remove := RemoveUser{When: when}
+	for _, target := range a.Targets {
+		if roles, wasMember := before.Members[target.PubKey]; wasMember {
+			restore.Targets = append(restore.Targets, PubKeyRoles{PubKey: target.PubKey, RoleNames: RoleNames(roles)})
+		} else {
+			remove.Targets = append(remove.Targets, target.PubKey)
+		}
+	}
+	return []Action{restore, remove}
+}
+
 type RemoveUser struct {
 	Targets []string
 	When    nostr.Timestamp
@@ -169,6 +255,16 @@ func (a RemoveUser) Apply(group *nip29.Group) {
 	}
 }
 
+func (a RemoveUser) Inverse(before *Group, when nostr.Timestamp) []Action {
+	restore := PutUser{When: when}
+	for _, tpk := range a.Targets {
+		if roles, wasMember := before.Members[tpk]; wasMember {
+			restore.Targets = append(restore.Targets, PubKeyRoles{PubKey: tpk, RoleNames: RoleNames(roles)})
+		}
+	}
+	return []Action{restore}
+}
+
 type EditMetadata struct {
 	NameValue    *string
 	PictureValue *string
@@ -176,6 +272,10 @@ type EditMetadata struct {
 	PrivateValue *bool
 	ClosedValue  *bool
 	When         nostr.Timestamp
+
+	// these are not part of nip29.Group, see directory.go
+	TopicsValue   *[]string
+	LanguageValue *string
 }
 
 func (_ EditMetadata) Name() string { return "edit-metadata" }
@@ -198,6 +298,35 @@ func (a EditMetadata) Apply(group *nip29.Group) {
 	}
 }
 
+func (a EditMetadata) Inverse(before *Group, when nostr.Timestamp) []Action {
+	// the values below point into the group, which will keep changing
+	before = before.snapshot()
+
+	restore := EditMetadata{When: when}
+	if a.NameValue != nil {
+		restore.NameValue = &before.Name
+	}
+	if a.PictureValue != nil {
+		restore.PictureValue = &before.Picture
+	}
+	if a.AboutValue != nil {
+		restore.AboutValue = &before.About
+	}
+	if a.PrivateValue != nil {
+		restore.PrivateValue = &before.Private
+	}
+	if a.ClosedValue != nil {
+		restore.ClosedValue = &before.Closed
+	}
+	if a.TopicsValue != nil {
+		restore.TopicsValue = &before.Topics
+	}
+	if a.LanguageValue != nil {
+		restore.LanguageValue = &before.Language
+	}
+	return []Action{restore}
+}
+
 type CreateGroup struct {
 	Creator string
 	When    nostr.Timestamp
@@ -226,3 +355,29 @@ func (a DeleteGroup) Apply(group *nip29.Group) {
 	group.LastAdminsUpdate = a.When
 	group.LastMembersUpdate = a.When
 }
+
+type Revert struct {
+	Target string   // id of the moderation event being reverted
+	Undo   []Action // actions that undo the target, computed from the group history when the revert is prepared
+	When   nostr.Timestamp
+}
+
+func (_ Revert) Name() string { return "revert" }
+func (a Revert) Apply(group *nip29.Group) {
+	for _, action := range a.Undo {
+		action.Apply(group)
+	}
+}
+
+func (a Revert) Inverse(before *Group, when nostr.Timestamp) []Action {
+	// reverting a revert means redoing what was undone
+	return inverseOfSequence(a.Undo, before, when)
+}
+
+type MoveGroup struct {
+	To   nip29.GroupAddress
+	When nostr.Timestamp
+}
+
+func (_ MoveGroup) Name() string             { return "move-group" }
+func (a MoveGroup) Apply(group *nip29.Group) {}
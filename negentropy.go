@@ -0,0 +1,399 @@
+package relay29
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"iter"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage"
+)
+
+// for NIP-77 (negentropy) syncing of group events we don't need the full events, only their ids and timestamps,
+// so instead of going to the database every time a client reconnects we keep these (plus what's needed to apply
+// simple filters) in a sorted list for each group. the list is loaded the first time someone syncs that group and
+// kept up-to-date by AddToNegentropyIndex and RemoveFromNegentropyIndex after that.
+//
+// next to the list we keep the sums of the ids (which is what negentropy fingerprints are made of) from the start up
+// to each item, so the fingerprint of any range is just the difference between two of these and a sync doesn't
+// have to go through all the ids of a big group again and again.
+//
+// access to the groups is checked by RequireKindAndSingleGroupIDOrSpecificEventReference before, like always.
+
+type negentropyIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	items  []negentropyItem
+
+	// sums[i] is the sum of the ids of items[:i], it's only kept as far as the items didn't change and the rest is
+	// computed again when needed
+	sums []idSum
+
+	// a snapshot is reading items and sums, so they must be copied before they are changed
+	shared bool
+
+	// while the index is loaded from the database the changes that happen are kept here and applied after
+	loading    chan struct{}
+	pending    []negentropyChange
+	generation int
+}
+
+type negentropyItem struct {
+	createdAt nostr.Timestamp
+	expiresAt nostr.Timestamp
+	kind      int
+	id        [32]byte
+}
+
+type negentropyChange struct {
+	item    negentropyItem
+	removed bool
+}
+
+func compareNegentropyItems(a, b negentropyItem) int {
+	return cmp.Or(cmp.Compare(a.createdAt, b.createdAt), bytes.Compare(a.id[:], b.id[:]))
+}
+
+func newNegentropyItem(event *nostr.Event) (negentropyItem, bool) {
+	item := negentropyItem{createdAt: event.CreatedAt, kind: event.Kind}
+	if n, err := hex.Decode(item.id[:], []byte(event.ID)); err != nil || n != 32 {
+		return item, false
+	}
+	if expiresAt := nip40.GetExpiration(event.Tags); expiresAt != -1 {
+		item.expiresAt = expiresAt
+	}
+	return item, true
+}
+
+// idSum is a 256-bit little-endian number, ids are added to it modulo 2^256 like NIP-77 says.
+type idSum [4]uint64
+
+func (sum idSum) add(id [32]byte) idSum {
+	var carry uint64
+	for i := range sum {
+		sum[i], carry = bits.Add64(sum[i], binary.LittleEndian.Uint64(id[i*8:]), carry)
+	}
+	return sum
+}
+
+func (sum idSum) sub(other idSum) idSum {
+	var borrow uint64
+	for i := range sum {
+		sum[i], borrow = bits.Sub64(sum[i], other[i], borrow)
+	}
+	return sum
+}
+
+func (sum idSum) fingerprint(n int) string {
+	var acc storage.Accumulator
+	for i, word := range sum {
+		binary.LittleEndian.PutUint64(acc.Buf[i*8:], word)
+	}
+	return acc.GetFingerprint(n)
+}
+
+// must be called with the lock held
+func (idx *negentropyIndex) unshare() {
+	if idx.shared {
+		idx.items = slices.Clone(idx.items)
+		idx.sums = slices.Clone(idx.sums)
+		idx.shared = false
+	}
+}
+
+// must be called with the lock held
+func (idx *negentropyIndex) insert(item negentropyItem) {
+	pos, exists := slices.BinarySearchFunc(idx.items, item, compareNegentropyItems)
+	if exists {
+		return
+	}
+	idx.unshare()
+	idx.items = slices.Insert(idx.items, pos, item)
+	idx.sums = idx.sums[0:min(len(idx.sums), pos+1)]
+}
+
+// must be called with the lock held
+func (idx *negentropyIndex) remove(item negentropyItem) {
+	pos, exists := slices.BinarySearchFunc(idx.items, item, compareNegentropyItems)
+	if !exists {
+		return
+	}
+	idx.unshare()
+	idx.items = slices.Delete(idx.items, pos, pos+1)
+	idx.sums = idx.sums[0:min(len(idx.sums), pos+1)]
+}
+
+// must be called with the lock held
+func (idx *negentropyIndex) change(item negentropyItem, removed bool) {
+	switch {
+	case idx.loading != nil:
+		idx.pending = append(idx.pending, negentropyChange{item, removed})
+	case !idx.loaded:
+		// it will be loaded from the database when needed
+	case removed:
+		idx.remove(item)
+	default:
+		idx.insert(item)
+	}
+}
+
+// reset makes the index be loaded again from the database the next time it's needed.
+func (idx *negentropyIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.loaded = false
+	idx.items = nil
+	idx.sums = nil
+	idx.shared = false
+	idx.pending = nil
+	idx.generation++ // whatever is being loaded now is already outdated
+}
+
+// load reads the index from the database if it isn't there yet. this can take a while for big groups, so it's done
+// without holding the lock and everything that happens in the meantime is applied at the end.
+func (idx *negentropyIndex) load(each func(fn func(*nostr.Event))) {
+	for {
+		idx.mu.Lock()
+		if idx.loaded {
+			idx.mu.Unlock()
+			return
+		}
+		if loading := idx.loading; loading != nil {
+			idx.mu.Unlock()
+			<-loading
+			continue
+		}
+		loading := make(chan struct{})
+		idx.loading = loading
+		generation := idx.generation
+		idx.mu.Unlock()
+
+		items := make([]negentropyItem, 0, 500)
+		each(func(event *nostr.Event) {
+			if item, ok := newNegentropyItem(event); ok {
+				items = append(items, item)
+			}
+		})
+		slices.SortFunc(items, compareNegentropyItems)
+		items = slices.CompactFunc(items, func(a, b negentropyItem) bool { return a.id == b.id })
+
+		idx.mu.Lock()
+		pending := idx.pending
+		idx.pending = nil
+		idx.loading = nil
+		if idx.generation == generation {
+			idx.items = items
+			idx.sums = nil
+			idx.shared = false
+			idx.loaded = true
+			for _, change := range pending {
+				idx.change(change.item, change.removed)
+			}
+		}
+		close(loading)
+		idx.mu.Unlock()
+	}
+}
+
+// snapshot gives the items (and their sums) as they are now, which can be read without the lock for as long as
+// needed since the index copies them before changing anything.
+func (idx *negentropyIndex) snapshot() ([]negentropyItem, []idSum) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if len(idx.sums) == 0 {
+		idx.sums = append(idx.sums, idSum{})
+	}
+	for i := len(idx.sums) - 1; i < len(idx.items); i++ {
+		idx.sums = append(idx.sums, idx.sums[i].add(idx.items[i].id))
+	}
+	idx.shared = true
+	return idx.items, idx.sums[0 : len(idx.items)+1]
+}
+
+// AddToNegentropyIndex is meant to be called after events are saved.
+func (s *State) AddToNegentropyIndex(ctx context.Context, event *nostr.Event) {
+	group := s.GetGroupFromEvent(event)
+	if group == nil {
+		return
+	}
+	item, ok := newNegentropyItem(event)
+	if !ok {
+		return
+	}
+
+	idx := &group.negentropy
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.change(item, false)
+}
+
+// RemoveFromNegentropyIndex is meant to be called when events are deleted.
+func (s *State) RemoveFromNegentropyIndex(ctx context.Context, event *nostr.Event) error {
+	group := s.GetGroupFromEvent(event)
+	if group == nil {
+		return nil
+	}
+	item, ok := newNegentropyItem(event)
+	if !ok {
+		return nil
+	}
+
+	idx := &group.negentropy
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.change(item, true)
+	return nil
+}
+
+// usesNegentropyIndex tells if a filter is simple enough to be answered from the index alone.
+func usesNegentropyIndex(ctx context.Context, filter nostr.Filter) bool {
+	return eventstore.IsNegentropySession(ctx) &&
+		len(filter.IDs) == 0 &&
+		len(filter.Authors) == 0 &&
+		len(filter.Tags) == 1 &&
+		filter.Search == ""
+}
+
+// negentropyStorage is what a negentropy session reads from, items are sorted from oldest to newest.
+type negentropyStorage struct {
+	items []negentropyItem
+	sums  []idSum
+}
+
+var _ negentropy.Storage = (*negentropyStorage)(nil)
+
+func (ns *negentropyStorage) Size() int { return len(ns.items) }
+
+func (ns *negentropyStorage) item(i int) negentropy.Item {
+	return negentropy.Item{Timestamp: ns.items[i].createdAt, ID: hex.EncodeToString(ns.items[i].id[:])}
+}
+
+func (ns *negentropyStorage) Range(begin, end int) iter.Seq2[int, negentropy.Item] {
+	return func(yield func(int, negentropy.Item) bool) {
+		for i := begin; i < end; i++ {
+			if !yield(i, ns.item(i)) {
+				return
+			}
+		}
+	}
+}
+
+func (ns *negentropyStorage) FindLowerBound(begin, end int, bound negentropy.Bound) int {
+	pos, _ := slices.BinarySearchFunc(ns.items[begin:end], bound.Item, func(item negentropyItem, target negentropy.Item) int {
+		return cmp.Or(
+			cmp.Compare(item.createdAt, target.Timestamp),
+			strings.Compare(hex.EncodeToString(item.id[:]), target.ID),
+		)
+	})
+	return begin + pos
+}
+
+func (ns *negentropyStorage) GetBound(i int) negentropy.Bound {
+	if i < len(ns.items) {
+		return negentropy.Bound{Item: ns.item(i)}
+	}
+	return negentropy.InfiniteBound
+}
+
+func (ns *negentropyStorage) Fingerprint(begin, end int) string {
+	return ns.sums[end].sub(ns.sums[begin]).fingerprint(end - begin)
+}
+
+// NegentropyStorage gives what a NIP-77 session for a filter with only "h" tags (and kinds, since, until and limit)
+// must reconcile, with the fingerprints already computed when the filter takes all the events of a single group
+// from some time on. this is for servers that run negentropy themselves, khatru builds its own vector from
+// QueryEvents (which uses the same index).
+//
+// access to the groups must have been checked before.
+func (s *State) NegentropyStorage(ctx context.Context, filter nostr.Filter) negentropy.Storage {
+	now := nostr.Now()
+	items := make([]negentropyItem, 0, 500)
+	whole := len(filter.Tags["h"]) == 1 && len(filter.Kinds) == 0
+	for _, groupId := range filter.Tags["h"] {
+		group, _ := s.Groups.Load(groupId)
+		if group == nil {
+			continue
+		}
+
+		idx := &group.negentropy
+		idx.load(func(fn func(*nostr.Event)) { s.eachGroupEvent(context.WithoutCancel(ctx), groupId, fn) })
+		all, allSums := idx.snapshot()
+
+		begin, end := 0, len(all)
+		if filter.Since != nil {
+			begin, _ = slices.BinarySearchFunc(all, *filter.Since, func(item negentropyItem, t nostr.Timestamp) int {
+				return cmp.Compare(item.createdAt, t)
+			})
+		}
+		if filter.Until != nil {
+			end, _ = slices.BinarySearchFunc(all, *filter.Until+1, func(item negentropyItem, t nostr.Timestamp) int {
+				return cmp.Compare(item.createdAt, t)
+			})
+			end = max(begin, end)
+		}
+
+		// expired events are hidden (even before they're deleted)
+		whole = whole && !slices.ContainsFunc(all[begin:end], func(item negentropyItem) bool {
+			return item.expiresAt != 0 && item.expiresAt <= now
+		})
+		if whole {
+			if filter.Limit > 0 && end-begin > filter.Limit {
+				begin = end - filter.Limit
+			}
+			return &negentropyStorage{items: all[begin:end], sums: allSums[begin : end+1]}
+		}
+
+		for _, item := range all[begin:end] {
+			if len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, item.kind) {
+				continue
+			}
+			if item.expiresAt != 0 && item.expiresAt <= now {
+				continue
+			}
+			items = append(items, item)
+		}
+	}
+
+	// a subset, so its sums are computed now
+	if len(filter.Tags["h"]) > 1 {
+		slices.SortFunc(items, compareNegentropyItems)
+	}
+	if filter.Limit > 0 && len(items) > filter.Limit {
+		items = items[len(items)-filter.Limit:]
+	}
+	sums := make([]idSum, len(items)+1)
+	for i, item := range items {
+		sums[i+1] = sums[i].add(item.id)
+	}
+	return &negentropyStorage{items: items, sums: sums}
+}
+
+// negentropyQuery answers a filter like NegentropyStorage. the events it returns have only the id, kind and
+// created_at, which is all negentropy needs.
+func (s *State) negentropyQuery(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ns := s.NegentropyStorage(ctx, filter).(*negentropyStorage)
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, item := range slices.Backward(ns.items) {
+			select {
+			case ch <- &nostr.Event{ID: hex.EncodeToString(item.id[:]), CreatedAt: item.createdAt, Kind: item.kind}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
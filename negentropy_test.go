@@ -0,0 +1,219 @@
+package relay29
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegentropyIndex(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	require.NoError(t, state.CreateGroup(ctx, "a", ownerPk, EditMetadata{}))
+
+	now := nostr.Now()
+	n := 0
+	publish := func(kind int, tags ...nostr.Tag) *nostr.Event {
+		n++
+		evt := &nostr.Event{CreatedAt: now + nostr.Timestamp(n), Kind: kind, Content: fmt.Sprintf("hi %d", n), Tags: append(nostr.Tags{{"h", "a"}}, tags...)}
+		evt.Sign(owner)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+		return evt
+	}
+
+	query := func(ctx context.Context, filter nostr.Filter) []string {
+		ch, err := state.NormalEventQuery(ctx, filter)
+		require.NoError(t, err)
+		ids := make([]string, 0, 5)
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	// the index must give the same results as the database
+	check := func(filter nostr.Filter) []string {
+		fromIndex := query(eventstore.SetNegentropy(ctx), filter)
+		require.ElementsMatch(t, query(ctx, filter), fromIndex)
+		return fromIndex
+	}
+
+	first := publish(9)
+	publish(11)
+	all := nostr.Filter{Tags: nostr.TagMap{"h": []string{"a"}}}
+	require.Len(t, check(all), 3) // including the group creation
+
+	// after it's loaded it's kept up-to-date
+	third := publish(9)
+	require.ElementsMatch(t, []string{third.ID, first.ID}, check(nostr.Filter{Kinds: []int{9}, Tags: all.Tags}))
+
+	publish(9005, nostr.Tag{"e", first.ID})
+	require.NotContains(t, check(all), first.ID)
+
+	// expired events are hidden (even before they're deleted)
+	state.Pipeline.OnEventSaved.Remove("ScheduleExpiration")
+	expired := publish(9, nostr.Tag{"expiration", "1"})
+	require.NotContains(t, check(all), expired.ID)
+}
+
+func TestNegentropySync(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	require.NoError(t, state.CreateGroup(ctx, "a", ownerPk, EditMetadata{}))
+
+	// the client has most of the events and a few the relay doesn't
+	client := vector.New()
+	missing := make([]string, 0, 10)
+	extra := make([]string, 0, 5)
+	now := nostr.Now()
+	for i := range 300 {
+		evt := &nostr.Event{CreatedAt: now + nostr.Timestamp(i/3), Kind: 9 + i%2, Content: fmt.Sprintf("hi %d", i), Tags: nostr.Tags{{"h", "a"}}}
+		evt.Sign(owner)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+		if i%30 == 0 {
+			missing = append(missing, evt.ID)
+		} else {
+			client.Insert(evt.CreatedAt, evt.ID)
+		}
+	}
+	for i := range 5 {
+		evt := &nostr.Event{CreatedAt: now + nostr.Timestamp(i*7), Kind: 9, Content: fmt.Sprintf("bye %d", i), Tags: nostr.Tags{{"h", "a"}}}
+		evt.Sign(owner)
+		client.Insert(evt.CreatedAt, evt.ID)
+		extra = append(extra, evt.ID)
+	}
+	client.Seal()
+
+	// the creation event is in the group too
+	history, _, err := state.moderationHistory(ctx, "a")
+	require.NoError(t, err)
+	missing = append(missing, history[0].ID)
+
+	sync := func(server negentropy.Storage) (need []string, have []string) {
+		neg := negentropy.New(client, 1024*1024)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for id := range neg.HaveNots {
+				need = append(need, id)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for id := range neg.Haves {
+				have = append(have, id)
+			}
+		}()
+		relay := negentropy.New(server, 1024*1024)
+		msg := neg.Start()
+		for msg != "" {
+			reply, err := relay.Reconcile(msg)
+			require.NoError(t, err)
+			msg, err = neg.Reconcile(reply)
+			require.NoError(t, err)
+		}
+		wg.Wait()
+		return need, have
+	}
+
+	// with the fingerprints kept in the index
+	whole := state.NegentropyStorage(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{"a"}}})
+	vec := vector.New()
+	for _, item := range whole.Range(0, whole.Size()) {
+		vec.Insert(item.Timestamp, item.ID)
+	}
+	vec.Seal()
+	for _, r := range [][2]int{{0, whole.Size()}, {0, 1}, {17, 180}, {299, 301}} {
+		require.Equal(t, vec.Fingerprint(r[0], r[1]), whole.Fingerprint(r[0], r[1]))
+	}
+	need, have := sync(whole)
+	require.ElementsMatch(t, missing, need)
+	require.ElementsMatch(t, extra, have)
+
+	// and with the ones computed for a subset
+	subset := state.NegentropyStorage(ctx, nostr.Filter{Kinds: []int{9, 10}, Tags: nostr.TagMap{"h": []string{"a"}}})
+	require.Equal(t, whole.Size()-1, subset.Size())
+	need, _ = sync(subset)
+	require.ElementsMatch(t, missing[0:len(missing)-1], need)
+}
+
+// blockingStore stops queries until it's released, once it's armed
+type blockingStore struct {
+	*MemoryStore
+	armed   *atomic.Bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if b.armed.Load() {
+		select {
+		case b.started <- struct{}{}:
+		default:
+		}
+		<-b.release
+	}
+	return b.MemoryStore.QueryEvents(ctx, filter)
+}
+
+func TestNegentropyIndexLoadsWithoutBlocking(t *testing.T) {
+	ctx := context.Background()
+	db := blockingStore{&MemoryStore{}, &atomic.Bool{}, make(chan struct{}), make(chan struct{})}
+	db.Init()
+	state := New(Options{Domain: "localhost", DB: db, SecretKey: nostr.GeneratePrivateKey(), NoBackgroundWork: true})
+	defer state.Close()
+	state.GetAuthed = func(context.Context) string { return "" }
+	state.Relay = testRelay{state}
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	require.NoError(t, state.CreateGroup(ctx, "a", ownerPk, EditMetadata{}))
+	db.armed.Store(true)
+
+	filter := nostr.Filter{Tags: nostr.TagMap{"h": []string{"a"}}}
+	loaded := make(chan negentropy.Storage)
+	go func() { loaded <- state.NegentropyStorage(ctx, filter) }()
+	<-db.started
+
+	// events can still be saved while the group is loaded
+	evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: "hi", Tags: nostr.Tags{{"h", "a"}}}
+	evt.Sign(owner)
+	saved := make(chan struct{})
+	go func() {
+		state.AddToNegentropyIndex(ctx, evt)
+		close(saved)
+	}()
+	select {
+	case <-saved:
+	case <-time.After(time.Second):
+		t.Fatal("saving was blocked by the loading")
+	}
+
+	// and they're there after
+	close(db.release)
+	ns := <-loaded
+	require.Equal(t, 2, ns.Size())
+	ids := make([]string, 0, 2)
+	for _, item := range ns.Range(0, ns.Size()) {
+		ids = append(ids, item.ID)
+	}
+	require.Contains(t, ids, evt.ID)
+}
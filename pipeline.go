@@ -0,0 +1,363 @@
+package relay29
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// Pipeline is everything a relay must do with events and filters for relay29 to work, in order. all the adapters
+// (khatru29, relayer29, strfry29) just hand events and filters to it, so anything added here applies to all of them.
+// the moderation events the relay generates itself go through it too, with a context for which IsInternalCall is true,
+// except for the RejectEvent stages: only the built-in checks that make sense for them are done.
+//
+// each step is a list of named stages that can be changed at any time, for example to add custom policies:
+//
+//	state.Pipeline.RejectEvent.InsertAfter("RequireHTagForExistingGroup", "PreventLargeTags", policies.PreventLargeTags(64))
+type Pipeline struct {
+	// RejectEvent stages are called before an event is stored, the first one that rejects wins
+	RejectEvent Stages[func(ctx context.Context, event *nostr.Event) (reject bool, msg string)]
+
+	// StoreEvent stages are all called to store an event, stopping at the first error
+	StoreEvent Stages[func(ctx context.Context, event *nostr.Event) error]
+
+	// OnEventSaved stages are all called after an event is stored
+	OnEventSaved Stages[func(ctx context.Context, event *nostr.Event)]
+
+	// DeleteEvent stages are all called to delete an event, stopping at the first error
+	DeleteEvent Stages[func(ctx context.Context, event *nostr.Event) error]
+
+	// RejectFilter stages are called before queries and counts, the first one that rejects wins
+	RejectFilter Stages[func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)]
+
+	// QueryEvents stages are called with the kinds they answer (see RouteKinds) and their results merged
+	QueryEvents Stages[func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)]
+
+	// CountEvents stages are all called and their results added
+	CountEvents Stages[func(ctx context.Context, filter nostr.Filter) (int64, error)]
+
+	// which kinds each QueryEvents stage answers, see RouteKinds
+	routesMu sync.RWMutex
+	routes   map[string][]int
+
+	// called with the name of the stage that rejected an event
+	rejected func(ctx context.Context, event *nostr.Event, stage string, msg string)
+}
+
+func (s *State) newPipeline() *Pipeline {
+	p := &Pipeline{routes: make(map[string][]int), rejected: s.recordRejection}
+
+	p.RejectEvent.Append("RejectWritesWhileFollowing", s.RejectWritesWhileFollowing)
+	p.RejectEvent.Append("RequireHTagForExistingGroup", fromClients(s.RequireHTagForExistingGroup))
+	p.RejectEvent.Append("RequireModerationEventsToBeRecent", fromClients(s.RequireModerationEventsToBeRecent))
+	p.RejectEvent.Append("RejectExpiredEvents", s.RejectExpiredEvents)
+	p.RejectEvent.Append("RestrictWritesBasedOnGroupRules", fromClients(s.RestrictWritesBasedOnGroupRules))
+	p.RejectEvent.Append("RestrictInvalidModerationActions", fromClients(s.RestrictInvalidModerationActions))
+	p.RejectEvent.Append("RequireModerationEventsInSequence", fromClients(s.RequireModerationEventsInSequence))
+	p.RejectEvent.Append("PreventWritingOfEventsJustDeleted", s.PreventWritingOfEventsJustDeleted)
+	p.RejectEvent.Append("CheckPreviousTag", s.CheckPreviousTag)
+
+	p.StoreEvent.Append("SaveEvent", func(ctx context.Context, event *nostr.Event) error {
+		return s.DB.SaveEvent(ctx, event)
+	})
+
+	p.OnEventSaved.Append("ApplyModerationAction", s.ApplyModerationAction)
+	p.OnEventSaved.Append("ReactToJoinRequest", s.ReactToJoinRequest)
+	p.OnEventSaved.Append("ReactToLeaveRequest", s.ReactToLeaveRequest)
+	p.OnEventSaved.Append("AddToPreviousChecking", s.AddToPreviousChecking)
+	p.OnEventSaved.Append("ScheduleExpiration", s.ScheduleExpiration)
+	p.OnEventSaved.Append("IndexForSearch", s.IndexForSearch)
+	p.OnEventSaved.Append("AddToNegentropyIndex", s.AddToNegentropyIndex)
+	p.OnEventSaved.Append("FeedReplicas", s.FeedReplicas)
+	p.OnEventSaved.Append("PublishChange", s.PublishChange)
+
+	p.DeleteEvent.Append("DeleteEvent", func(ctx context.Context, event *nostr.Event) error {
+		return s.DB.DeleteEvent(ctx, event)
+	})
+	p.DeleteEvent.Append("RemoveFromSearchIndex", s.RemoveFromSearchIndex)
+	p.DeleteEvent.Append("RemoveFromNegentropyIndex", s.RemoveFromNegentropyIndex)
+
+	p.RejectFilter.Append("RequireKindAndSingleGroupIDOrSpecificEventReference", s.RequireKindAndSingleGroupIDOrSpecificEventReference)
+
+	p.QueryEvents.Append("NormalEventQuery", s.NormalEventQuery)
+	p.QueryEvents.Append("MetadataEventsQueryHandler", s.MetadataEventsQueryHandler)
+	p.QueryEvents.Append("MembersDeltaQueryHandler", s.MembersDeltaQueryHandler)
+	p.QueryEvents.Append("AuditLogQueryHandler", s.AuditLogQueryHandler)
+	p.RouteKinds("MetadataEventsQueryHandler", nip29.MetadataEventKinds...)
+	p.RouteKinds("MembersDeltaQueryHandler", KindSimpleGroupMembersDelta)
+	p.RouteKinds("AuditLogQueryHandler", KindSimpleGroupAuditEntry)
+
+	p.CountEvents.Append("CountEvents", s.CountEvents)
+
+	return p
+}
+
+// fromClients skips a check for the events we generate ourselves, applyEvents checks these against the group state in
+// a way that works for batches of events that depend on each other.
+func fromClients(
+	check func(ctx context.Context, event *nostr.Event) (reject bool, msg string),
+) func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if IsInternalCall(ctx) {
+			return false, ""
+		}
+		return check(ctx, event)
+	}
+}
+
+// Reject runs the RejectEvent stages.
+func (p *Pipeline) Reject(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	for _, st := range p.RejectEvent.stages() {
+		if reject, msg := st.fn(ctx, event); reject {
+			if p.rejected != nil {
+				p.rejected(ctx, event, st.name, msg)
+			}
+			return reject, msg
+		}
+	}
+	return false, ""
+}
+
+// Store runs the StoreEvent stages.
+func (p *Pipeline) Store(ctx context.Context, event *nostr.Event) error {
+	for _, fn := range p.StoreEvent.Funcs() {
+		if err := fn(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AfterSave runs the OnEventSaved stages.
+func (p *Pipeline) AfterSave(ctx context.Context, event *nostr.Event) {
+	for _, fn := range p.OnEventSaved.Funcs() {
+		fn(ctx, event)
+	}
+}
+
+// Delete runs the DeleteEvent stages.
+func (p *Pipeline) Delete(ctx context.Context, event *nostr.Event) error {
+	for _, fn := range p.DeleteEvent.Funcs() {
+		if err := fn(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RejectQuery runs the RejectFilter stages.
+func (p *Pipeline) RejectQuery(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	for _, fn := range p.RejectFilter.Funcs() {
+		if reject, msg := fn(ctx, filter); reject {
+			return reject, msg
+		}
+	}
+	return false, ""
+}
+
+// RouteKinds tells that a QueryEvents stage only answers queries for the given kinds. filters with kinds are split so
+// each of these stages only gets the kinds it knows about and the stages without routes get all the other kinds.
+func (p *Pipeline) RouteKinds(stage string, kinds ...int) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+	p.routes[stage] = kinds
+}
+
+// Query runs the QueryEvents stages, each with the part of the filter it can answer, and merges their results.
+func (p *Pipeline) Query(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	stages := p.QueryEvents.stages()
+
+	p.routesMu.RLock()
+	routed := make([]int, 0, 8)
+	for _, kinds := range p.routes {
+		routed = append(routed, kinds...)
+	}
+	chs := make([]chan *nostr.Event, 0, len(stages))
+	for _, st := range stages {
+		f := filter
+		if len(filter.Kinds) > 0 {
+			if kinds, ok := p.routes[st.name]; ok {
+				f.Kinds = slices.DeleteFunc(slices.Clone(filter.Kinds), func(kind int) bool { return !slices.Contains(kinds, kind) })
+			} else {
+				f.Kinds = slices.DeleteFunc(slices.Clone(filter.Kinds), func(kind int) bool { return slices.Contains(routed, kind) })
+			}
+			if len(f.Kinds) == 0 {
+				// nothing for this one
+				continue
+			}
+		}
+
+		ch, err := st.fn(ctx, f)
+		if err != nil {
+			p.routesMu.RUnlock()
+			// the ones that were already started must be allowed to finish
+			for _, ch := range chs {
+				go func() {
+					for range ch {
+					}
+				}()
+			}
+			return nil, err
+		}
+		if ch != nil {
+			chs = append(chs, ch)
+		}
+	}
+	p.routesMu.RUnlock()
+
+	if len(chs) == 1 {
+		return chs[0], nil
+	}
+
+	res := make(chan *nostr.Event)
+
+	if filter.Limit > 0 {
+		// each stage respects the limit on its own, so we take the newest from all of them
+		go func() {
+			defer close(res)
+			events := make([]*nostr.Event, 0, filter.Limit*len(chs))
+			for _, ch := range chs {
+				for evt := range ch {
+					events = append(events, evt)
+				}
+			}
+			slices.SortStableFunc(events, func(a, b *nostr.Event) int { return cmp.Compare(b.CreatedAt, a.CreatedAt) })
+			for _, evt := range events[0:min(filter.Limit, len(events))] {
+				select {
+				case res <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return res, nil
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(chs))
+	for _, ch := range chs {
+		go func() {
+			defer wg.Done()
+			for evt := range ch {
+				select {
+				case res <- evt:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(res)
+	}()
+	return res, nil
+}
+
+// Count runs all the CountEvents stages and adds their results.
+func (p *Pipeline) Count(ctx context.Context, filter nostr.Filter) (int64, error) {
+	var total int64
+	for _, fn := range p.CountEvents.Funcs() {
+		count, err := fn(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Stages is an ordered list of named functions.
+type Stages[F any] struct {
+	mu   sync.RWMutex
+	list []stage[F]
+}
+
+type stage[F any] struct {
+	name string
+	fn   F
+}
+
+// Append adds a stage to the end of the list.
+func (ss *Stages[F]) Append(name string, fn F) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list = append(ss.list, stage[F]{name, fn})
+}
+
+// InsertBefore adds a stage right before an existing one, it panics if there is no stage with that name.
+func (ss *Stages[F]) InsertBefore(before string, name string, fn F) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list = slices.Insert(ss.list, ss.mustFind(before), stage[F]{name, fn})
+}
+
+// InsertAfter adds a stage right after an existing one, it panics if there is no stage with that name.
+func (ss *Stages[F]) InsertAfter(after string, name string, fn F) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list = slices.Insert(ss.list, ss.mustFind(after)+1, stage[F]{name, fn})
+}
+
+// Replace swaps the function of an existing stage, it panics if there is no stage with that name.
+func (ss *Stages[F]) Replace(name string, fn F) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list[ss.mustFind(name)].fn = fn
+}
+
+// Remove takes a stage out of the list, it returns false if there was no stage with that name.
+func (ss *Stages[F]) Remove(name string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	idx := ss.find(name)
+	if idx == -1 {
+		return false
+	}
+	ss.list = slices.Delete(ss.list, idx, idx+1)
+	return true
+}
+
+// Names returns the names of all stages, in order.
+func (ss *Stages[F]) Names() []string {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	names := make([]string, len(ss.list))
+	for i, st := range ss.list {
+		names[i] = st.name
+	}
+	return names
+}
+
+func (ss *Stages[F]) stages() []stage[F] {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return slices.Clone(ss.list)
+}
+
+// Funcs returns the functions of all stages, in order.
+func (ss *Stages[F]) Funcs() []F {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	fns := make([]F, len(ss.list))
+	for i, st := range ss.list {
+		fns[i] = st.fn
+	}
+	return fns
+}
+
+func (ss *Stages[F]) find(name string) int {
+	return slices.IndexFunc(ss.list, func(st stage[F]) bool { return st.name == name })
+}
+
+func (ss *Stages[F]) mustFind(name string) int {
+	idx := ss.find(name)
+	if idx == -1 {
+		panic(fmt.Errorf("there is no stage named '%s'", name))
+	}
+	return idx
+}
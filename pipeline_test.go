@@ -0,0 +1,162 @@
+package relay29
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+	p := state.Pipeline
+
+	require.Equal(t, "RejectWritesWhileFollowing", p.RejectEvent.Names()[0])
+	require.Contains(t, p.OnEventSaved.Names(), "ApplyModerationAction")
+
+	// custom stages go where we want them
+	calls := make([]string, 0, 3)
+	p.RejectEvent.InsertBefore("RejectWritesWhileFollowing", "first", func(ctx context.Context, event *nostr.Event) (bool, string) {
+		calls = append(calls, "first")
+		return false, ""
+	})
+	p.RejectEvent.InsertAfter("first", "second", func(ctx context.Context, event *nostr.Event) (bool, string) {
+		calls = append(calls, "second")
+		return event.Content == "no", "blocked: said no"
+	})
+	require.Equal(t, []string{"first", "second", "RejectWritesWhileFollowing"}, p.RejectEvent.Names()[0:3])
+	require.Panics(t, func() { p.RejectEvent.InsertAfter("nothing", "x", nil) })
+
+	// events we generate ourselves don't go through them
+	creator := nostr.GeneratePrivateKey()
+	creatorPk, _ := nostr.GetPublicKey(creator)
+	require.NoError(t, state.CreateGroup(ctx, "g", creatorPk, EditMetadata{}))
+	require.Empty(t, calls)
+
+	evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: "no", Tags: nostr.Tags{{"h", "g"}}}
+	evt.Sign(creator)
+	reject, msg := p.Reject(ctx, evt)
+	require.True(t, reject)
+	require.Equal(t, "blocked: said no", msg)
+	require.Equal(t, []string{"first", "second"}, calls)
+
+	require.True(t, p.RejectEvent.Remove("second"))
+	require.False(t, p.RejectEvent.Remove("second"))
+	reject, _ = p.Reject(ctx, evt)
+	require.False(t, reject)
+
+	// store and after-save hooks
+	saved := false
+	p.OnEventSaved.Append("mark", func(ctx context.Context, event *nostr.Event) { saved = true })
+	require.NoError(t, p.Store(ctx, evt))
+	p.AfterSave(ctx, evt)
+	require.True(t, saved)
+	saved = false
+	require.NoError(t, state.PutUser(ctx, "g", creatorPk, "moderator"))
+	require.True(t, saved)
+
+	// queries go through all the stages
+	for _, filter := range []nostr.Filter{
+		{Kinds: []int{9}, Tags: nostr.TagMap{"h": {"g"}}},
+		{Kinds: []int{39000}, Tags: nostr.TagMap{"d": {"g"}}},
+	} {
+		ch, err := p.Query(ctx, filter)
+		require.NoError(t, err)
+		kinds := make([]int, 0, 1)
+		for evt := range ch {
+			kinds = append(kinds, evt.Kind)
+		}
+		require.Equal(t, filter.Kinds, kinds)
+	}
+	count, err := p.Count(ctx, nostr.Filter{Kinds: []int{9}, Tags: nostr.TagMap{"h": {"g"}}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+}
+
+func TestPipelineQueryRouting(t *testing.T) {
+	ctx := context.Background()
+	p := newTestState().Pipeline
+
+	// see what each stage gets
+	got := make(map[string][]int)
+	mu := sync.Mutex{}
+	recorder := func(name string, results ...int) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			mu.Lock()
+			got[name] = filter.Kinds
+			mu.Unlock()
+			ch := make(chan *nostr.Event, len(results))
+			for _, kind := range results {
+				ch <- &nostr.Event{Kind: kind, CreatedAt: nostr.Timestamp(kind)}
+			}
+			close(ch)
+			return ch, nil
+		}
+	}
+	p.QueryEvents.Replace("NormalEventQuery", recorder("normal", 9, 9, 9))
+	p.QueryEvents.Replace("MetadataEventsQueryHandler", recorder("metadata", 39000, 39002))
+	p.QueryEvents.Replace("MembersDeltaQueryHandler", recorder("delta"))
+	p.QueryEvents.Replace("AuditLogQueryHandler", recorder("audit"))
+	p.QueryEvents.Append("custom", recorder("custom", 1))
+	p.RouteKinds("custom", 1)
+
+	query := func(filter nostr.Filter) int {
+		clear(got)
+		ch, err := p.Query(ctx, filter)
+		require.NoError(t, err)
+		count := 0
+		for range ch {
+			count++
+		}
+		return count
+	}
+
+	// mixed filters are split
+	require.Equal(t, 6, query(nostr.Filter{Kinds: []int{9, 39000, 39002, 1}}))
+	require.Equal(t, map[string][]int{"normal": {9}, "metadata": {39000, 39002}, "custom": {1}}, got)
+
+	// and only go where they must
+	require.Equal(t, 2, query(nostr.Filter{Kinds: []int{39000, 39002}}))
+	require.Equal(t, map[string][]int{"metadata": {39000, 39002}}, got)
+	require.Equal(t, 0, query(nostr.Filter{Kinds: []int{KindSimpleGroupMembersDelta}}))
+	require.Equal(t, map[string][]int{"delta": {KindSimpleGroupMembersDelta}}, got)
+
+	// filters without kinds go everywhere
+	query(nostr.Filter{})
+	require.Len(t, got, 5)
+
+	// together they respect the limit, keeping the newest
+	ch, err := p.Query(ctx, nostr.Filter{Kinds: []int{9, 39000, 39002, 1}, Limit: 4})
+	require.NoError(t, err)
+	kinds := make([]int, 0, 4)
+	for evt := range ch {
+		kinds = append(kinds, evt.Kind)
+	}
+	require.Equal(t, []int{39002, 39000, 9, 9}, kinds)
+
+	// when one fails the others are not left hanging
+	finished := make(chan struct{})
+	p.QueryEvents.Replace("NormalEventQuery", func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(finished)
+			ch <- &nostr.Event{Kind: 9}
+			close(ch)
+		}()
+		return ch, nil
+	})
+	p.QueryEvents.Replace("custom", func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		return nil, errorString("broken")
+	})
+	_, err = p.Query(ctx, nostr.Filter{Kinds: []int{9, 1}})
+	require.Error(t, err)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("query stage was never drained")
+	}
+}
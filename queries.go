@@ -1,231 +1,199 @@
 package relay29
 
 import (
+	"cmp"
 	"context"
+	"slices"
 
 	"github.com/fiatjaf/set"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip29"
-	"golang.org/x/exp/slices"
 )
 
-func (s *State) MetadataQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
+// MetadataEventsQueryHandler answers queries for the 39000-39003 events of all groups, matching them against the
+// filter like they were stored events would be, newest first.
+func (s *State) MetadataEventsQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.queryMetadata(ctx, filter, nip29.MetadataEventKinds...)
+}
 
-	authed := s.GetAuthed(ctx)
-	go func() {
-		if slices.Contains(filter.Kinds, nostr.KindSimpleGroupMetadata) {
-			if _, ok := filter.Tags["d"]; !ok {
-				// no "d" tag specified, return everything
-				for _, group := range s.Groups.Range {
-					if group.Private {
-						// don't reveal metadata about private groups in lists unless we're a member
-						if authed == "" {
-							continue
-						}
-						if _, isMember := group.Members[authed]; !isMember {
-							continue
-						}
-					} else if group.Closed {
-						// closed groups also shouldn't be listed since people can't freely join them
-						continue
-					}
+// MetadataQueryHandler is like MetadataEventsQueryHandler, but only for 39000 events.
+func (s *State) MetadataQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.queryMetadata(ctx, filter, nostr.KindSimpleGroupMetadata)
+}
 
-					evt := group.ToMetadataEvent()
-					evt.Sign(s.secretKey)
-					ch <- evt
-				}
-			} else {
-				for _, groupId := range filter.Tags["d"] {
-					if group, _ := s.Groups.Load(groupId); group != nil {
-						evt := group.ToMetadataEvent()
-						evt.Sign(s.secretKey)
-						ch <- evt
-					}
-				}
-			}
-		}
+// AdminsQueryHandler is like MetadataEventsQueryHandler, but only for 39001 events.
+func (s *State) AdminsQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.queryMetadata(ctx, filter, nostr.KindSimpleGroupAdmins)
+}
 
-		close(ch)
-	}()
+// MembersQueryHandler is like MetadataEventsQueryHandler, but only for 39002 events.
+func (s *State) MembersQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.queryMetadata(ctx, filter, nostr.KindSimpleGroupMembers)
+}
 
-	return ch, nil
+// RolesQueryHandler is like MetadataEventsQueryHandler, but only for 39003 events.
+func (s *State) RolesQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.queryMetadata(ctx, filter, nostr.KindSimpleGroupRoles)
 }
 
-func (s *State) AdminsQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
+func (s *State) queryMetadata(ctx context.Context, filter nostr.Filter, handledKinds ...int) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+
+	kinds := make([]int, 0, len(handledKinds))
+	for _, kind := range handledKinds {
+		if slices.Contains(filter.Kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) == 0 || filter.LimitZero || (len(filter.Authors) > 0 && !slices.Contains(filter.Authors, s.publicKey)) {
+		close(ch)
+		return ch, nil
+	}
 
 	authed := s.GetAuthed(ctx)
 	go func() {
-		if slices.Contains(filter.Kinds, nostr.KindSimpleGroupAdmins) {
-			if _, ok := filter.Tags["d"]; !ok {
-				// no "d" tag specified, return everything
-				for _, group := range s.Groups.Range {
-					if group.Private {
-						// don't reveal lists of admins of private groups unless we're a member
-						if authed == "" {
-							continue
-						}
-						if _, isMember := group.Members[authed]; !isMember {
-							continue
-						}
-					}
-					if pks, hasPTags := filter.Tags["p"]; hasPTags && !hasOneOfTheseAdmins(group.Group, pks) {
-						// filter queried p tags
-						// TODO
-						continue
-					}
-					evt := group.ToAdminsEvent()
-					evt.Sign(s.secretKey)
-					ch <- evt
-				}
-			} else {
-				for _, groupId := range filter.Tags["d"] {
-					if group, _ := s.Groups.Load(groupId); group != nil {
-						if group.Private {
-							// don't reveal lists of admins of private groups unless we're a member
-							if authed == "" {
-								continue
-							}
-							if _, isMember := group.Members[authed]; !isMember {
-								continue
-							}
+		defer close(ch)
+
+		// pick the groups we're going to look at
+		groups := s.Groups.Range
+		ids, hasDTags := filter.Tags["d"]
+		pks, hasPTags := filter.Tags["p"]
+		if hasDTags {
+			groups = func(yield func(string, *Group) bool) {
+				for _, id := range ids {
+					if group, _ := s.Groups.Load(id); group != nil {
+						if !yield(id, group) {
+							return
 						}
-						if pks, hasPTags := filter.Tags["p"]; hasPTags && !hasOneOfTheseAdmins(group.Group, pks) {
-							// filter queried p tags
-							// TODO
-							continue
-						}
-						evt := group.ToAdminsEvent()
-						evt.Sign(s.secretKey)
-						ch <- evt
 					}
 				}
 			}
+		} else if hasPTags {
+			// only the groups these people are in (this is how people get the list of their own groups)
+			groups = s.groupsWith(pks)
 		}
 
-		close(ch)
-	}()
+		// 39000 events have no "p" tags, so for them the "p" tags only work through the selection above
+		withoutPTags := filter
+		if hasPTags {
+			withoutPTags.Tags = make(nostr.TagMap, len(filter.Tags)-1)
+			for k, v := range filter.Tags {
+				if k != "p" {
+					withoutPTags.Tags[k] = v
+				}
+			}
+		}
 
-	return ch, nil
-}
+		// see directory.go
+		search := parseDirectorySearch(filter.Search)
 
-func (s *State) MembersQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
+		type result struct {
+			evt *nostr.Event
+			key int64
+		}
+		results := make([]result, 0, 100)
+		for _, group := range groups {
+			if ctx.Err() != nil {
+				return
+			}
 
-	authed := s.GetAuthed(ctx)
-	go func() {
-		if slices.Contains(filter.Kinds, nostr.KindSimpleGroupMembers) {
-			if _, ok := filter.Tags["d"]; !ok {
-				// no "d" tag specified, return everything
-				for _, group := range s.Groups.Range {
-					if group.Private {
-						// don't reveal lists of members of private groups unless we're a member
-						if authed == "" {
-							continue
-						}
-						if _, isMember := group.Members[authed]; !isMember {
-							continue
-						}
-					}
-					if pks, hasPTags := filter.Tags["p"]; hasPTags && !hasOneOfTheseMembers(group.Group, pks) {
-						// filter queried p tags
-						// TODO
+			group.mu.RLock()
+			if search.matches(group) {
+				for _, kind := range kinds {
+					// only the 39000 events are used for listing groups
+					listing := !hasDTags && kind == nostr.KindSimpleGroupMetadata
+					if !s.visibleGroup(group, authed, listing, hasPTags) {
 						continue
 					}
-					evt := group.ToMembersEvent()
-					evt.Sign(s.secretKey)
-					ch <- evt
-				}
-			} else {
-				for _, groupId := range filter.Tags["d"] {
-					if group, _ := s.Groups.Load(groupId); group != nil {
-						if group.Private {
-							// don't reveal lists of members of private groups ever
-							if authed == "" {
-								continue
-							}
-							if _, isMember := group.Members[authed]; !isMember {
-								continue
-							}
-						}
-						if pks, hasPTags := filter.Tags["p"]; hasPTags && !hasOneOfTheseMembers(group.Group, pks) {
-							// filter queried p tags
-							// TODO
-							continue
-						}
-						evt := group.ToMembersEvent()
-						evt.Sign(s.secretKey)
-						ch <- evt
+					evt := s.signedMetadataEvent(group, kind)
+					matcher := filter
+					if kind == nostr.KindSimpleGroupMetadata {
+						matcher = withoutPTags
+					}
+					if matcher.Matches(evt) {
+						results = append(results, result{evt, search.sortKey(group, evt.CreatedAt)})
 					}
 				}
 			}
+			group.mu.RUnlock()
 		}
 
-		close(ch)
-	}()
-
-	return ch, nil
-}
-
-func (s *State) RolesQueryHandler(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event, 1)
+		// newest first like everything else, unless some other order was asked for
+		slices.SortFunc(results, func(a, b result) int {
+			return cmp.Or(cmp.Compare(b.key, a.key), cmp.Compare(b.evt.CreatedAt, a.evt.CreatedAt))
+		})
+		if filter.Limit > 0 && len(results) > filter.Limit {
+			results = results[0:filter.Limit]
+		}
 
-	authed := s.GetAuthed(ctx)
-	go func() {
-		if slices.Contains(filter.Kinds, nostr.KindSimpleGroupRoles) {
-			if _, ok := filter.Tags["d"]; !ok {
-				// no "d" tag specified, return everything
-				for _, group := range s.Groups.Range {
-					if group.Private {
-						// don't reveal lists of roles of private groups unless we're a member
-						if authed == "" {
-							continue
-						}
-						if _, isMember := group.Members[authed]; !isMember {
-							continue
-						}
-					}
-					evt := group.ToRolesEvent()
-					evt.Sign(s.secretKey)
-					ch <- evt
-				}
-			} else {
-				for _, groupId := range filter.Tags["d"] {
-					if group, _ := s.Groups.Load(groupId); group != nil {
-						if group.Private {
-							// don't reveal lists of members of private groups ever
-							if authed == "" {
-								continue
-							}
-							if _, isMember := group.Members[authed]; !isMember {
-								continue
-							}
-						}
-						evt := group.ToRolesEvent()
-						evt.Sign(s.secretKey)
-						ch <- evt
-					}
-				}
+		for _, res := range results {
+			select {
+			case ch <- res.evt:
+			case <-ctx.Done():
+				return
 			}
 		}
-
-		close(ch)
 	}()
 
 	return ch, nil
 }
 
+// visibleGroup tells if the metadata of a group can be shown to someone. it must be called with the group lock held
+// (for reading, at least).
+func (s *State) visibleGroup(group *Group, authed string, listing bool, byMembers bool) bool {
+	_, isMember := group.Members[authed]
+	isMember = isMember && authed != ""
+
+	if group.Private {
+		// don't reveal anything about private groups unless we're a member
+		return isMember
+	}
+	if group.Closed && listing && !(byMembers && isMember) {
+		// closed groups also shouldn't be listed since people can't freely join them
+		// (unless we're specifically asking for the groups we are in)
+		return false
+	}
+	return true
+}
+
 func (s *State) NormalEventQuery(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if s.GetAuthed(ctx) == s.publicKey {
+		// a follower is replicating everything from us (see replication.go)
+		return s.DB.QueryEvents(ctx, filter)
+	}
+
 	if hTags, hasHTags := filter.Tags["h"]; hasHTags && len(hTags) > 0 {
 		// if these tags are present we already know access is safe because we've verified that in filter_policy.go
-		return s.DB.QueryEvents(ctx, filter)
+		if filter.Search != "" {
+			return s.searchQuery(ctx, filter)
+		}
+		if usesNegentropyIndex(ctx, filter) {
+			return s.negentropyQuery(ctx, filter)
+		}
+
+		results, err := s.DB.QueryEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		// but we still have to hide the events that have expired and weren't deleted yet
+		ch := make(chan *nostr.Event)
+		go func() {
+			now := nostr.Now()
+			for evt := range results {
+				if !isExpired(evt, now) {
+					ch <- evt
+				}
+			}
+			close(ch)
+		}()
+		return ch, nil
 	}
 
 	ch := make(chan *nostr.Event)
 	authed := s.GetAuthed(ctx)
 	go func() {
-		// now here in refE/refA/ids we have to check for each result if it is allowed
+		// now here in refE/refA/ids/feeds we have to check for each result if it is allowed
 		var results chan *nostr.Event
 		var err error
 		if refE, ok := filter.Tags["e"]; ok && len(refE) > 0 {
@@ -234,6 +202,10 @@ func (s *State) NormalEventQuery(ctx context.Context, filter nostr.Filter) (chan
 			results, err = s.DB.QueryEvents(ctx, filter)
 		} else if len(filter.IDs) > 0 {
 			results, err = s.DB.QueryEvents(ctx, filter)
+		} else if isFeedQuery(filter) {
+			if expanded, ok := s.expandFeed(filter, authed); ok {
+				results, err = s.DB.QueryEvents(ctx, expanded)
+			}
 		}
 
 		if err != nil || results == nil {
@@ -242,9 +214,13 @@ func (s *State) NormalEventQuery(ctx context.Context, filter nostr.Filter) (chan
 			return
 		}
 
+		now := nostr.Now()
 		allowed := set.NewSliceSet[string]()
 		disallowed := set.NewSliceSet[string]()
 		for evt := range results {
+			if isExpired(evt, now) {
+				continue
+			}
 			if group := s.GetGroupFromEvent(evt); !group.Private || allowed.Has(group.Address.ID) {
 				ch <- evt
 			} else if authed != "" && !disallowed.Has(group.Address.ID) {
@@ -263,21 +239,3 @@ func (s *State) NormalEventQuery(ctx context.Context, filter nostr.Filter) (chan
 
 	return ch, nil
 }
-
-func hasOneOfTheseMembers(group nip29.Group, pubkeys []string) bool {
-	for _, pk := range pubkeys {
-		if _, ok := group.Members[pk]; ok {
-			return true
-		}
-	}
-	return false
-}
-
-func hasOneOfTheseAdmins(group nip29.Group, pubkeys []string) bool {
-	for _, pk := range pubkeys {
-		if role, ok := group.Members[pk]; ok && role != nil {
-			return true
-		}
-	}
-	return false
-}
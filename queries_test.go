@@ -0,0 +1,86 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataQueries(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	yes := true
+
+	// moderation events are replayed in timestamp order so we can't have them all in the same second
+	now := nostr.Now() - 100
+	for _, id := range []string{"q1", "q2", "q3"} {
+		now++
+		require.NoError(t, state.applyEvents(ctx, &nostr.Event{
+			CreatedAt: now,
+			Kind:      nostr.KindSimpleGroupCreateGroup,
+			Tags:      nostr.Tags{{"h", id}},
+		}, &nostr.Event{
+			CreatedAt: now,
+			Kind:      nostr.KindSimpleGroupEditMetadata,
+			Tags:      nostr.Tags{{"h", id}, {"name", id}},
+		}))
+	}
+	require.NoError(t, state.CreateGroup(ctx, "secret", owner, EditMetadata{PrivateValue: &yes}))
+
+	query := func(filter nostr.Filter) []string {
+		ch, err := state.MetadataEventsQueryHandler(ctx, filter)
+		require.NoError(t, err)
+		ids := make([]string, 0, 4)
+		for evt := range ch {
+			ids = append(ids, evt.Tags.GetD())
+		}
+		return ids
+	}
+	meta := []int{nostr.KindSimpleGroupMetadata}
+
+	// newest first
+	require.Equal(t, []string{"q3", "q2", "q1"}, query(nostr.Filter{Kinds: meta}))
+	require.Equal(t, []string{"q3", "q2"}, query(nostr.Filter{Kinds: meta, Limit: 2}))
+
+	// since and until
+	since, until := now-1, now-1
+	require.Equal(t, []string{"q3", "q2"}, query(nostr.Filter{Kinds: meta, Since: &since}))
+	require.Equal(t, []string{"q2", "q1"}, query(nostr.Filter{Kinds: meta, Until: &until}))
+
+	// authors
+	require.Len(t, query(nostr.Filter{Kinds: meta, Authors: []string{owner}}), 0)
+	require.Len(t, query(nostr.Filter{Kinds: meta, Authors: []string{state.publicKey}}), 3)
+
+	// ids
+	ch, _ := state.MetadataEventsQueryHandler(ctx, nostr.Filter{Kinds: meta, Tags: nostr.TagMap{"d": []string{"q2"}}})
+	q2 := <-ch
+	require.Equal(t, []string{"q2"}, query(nostr.Filter{Kinds: meta, IDs: []string{q2.ID}}))
+
+	// other kinds
+	require.Len(t, query(nostr.Filter{Kinds: []int{nostr.KindSimpleGroupRoles, nostr.KindSimpleGroupAdmins}}), 6)
+
+	// private groups are hidden even when asked for directly
+	require.Len(t, query(nostr.Filter{Kinds: meta, Tags: nostr.TagMap{"d": []string{"secret"}}}), 0)
+	state.GetAuthed = func(context.Context) string { return owner }
+	require.Equal(t, []string{"secret"}, query(nostr.Filter{Kinds: meta, Tags: nostr.TagMap{"d": []string{"secret"}}}))
+
+	// closed groups aren't listed, but everything else about them can be seen
+	state.GetAuthed = func(context.Context) string { return "" }
+	require.NoError(t, state.CreateGroup(ctx, "closed", owner, EditMetadata{ClosedValue: &yes}))
+	require.NotContains(t, query(nostr.Filter{Kinds: meta}), "closed")
+	require.Contains(t, query(nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMembers}}), "closed")
+	require.Contains(t, query(nostr.Filter{Kinds: []int{nostr.KindSimpleGroupAdmins}}), "closed")
+	require.Equal(t, []string{"closed"}, query(nostr.Filter{Kinds: meta, Tags: nostr.TagMap{"d": []string{"closed"}}}))
+
+	// and we stop when the client goes away
+	cancelled, cancel := context.WithCancel(ctx)
+	ch, _ = state.MetadataEventsQueryHandler(cancelled, nostr.Filter{Kinds: meta})
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
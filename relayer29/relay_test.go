@@ -0,0 +1,40 @@
+package relayer29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/relay29/internal/relaytest"
+	"github.com/fiatjaf/relayer/v2"
+)
+
+func startTestRelay(t *testing.T) func() {
+	relay, state := Init(relaytest.Options("localhost:29293"))
+	relaytest.Setup(state)
+	relay.(*Relay).URL = "ws://localhost:29293"
+
+	server, err := relayer.NewServer(relay)
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+
+	started := make(chan bool)
+	go func() {
+		server.Start("localhost", 29293, started)
+	}()
+	<-started
+
+	return func() {
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestGroupStuffABunch(t *testing.T) {
+	defer startTestRelay(t)()
+	relaytest.GroupStuffABunch(t, "ws://localhost:29293")
+}
+
+func TestExpiration(t *testing.T) {
+	defer startTestRelay(t)()
+	relaytest.Expiration(t, "ws://localhost:29293")
+}
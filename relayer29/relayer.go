@@ -14,9 +14,13 @@ import (
 type Relay struct {
 	NIP11Info  func() nip11.RelayInformationDocument
 	RejectFunc func(*nostr.Event) (bool, string)
-	pubkey     string
-	opts       relay29.Options
-	state      *relay29.State
+
+	// URL is what clients must have in their NIP-42 auth events, defaults to wss://<Domain>
+	URL string
+
+	pubkey string
+	opts   relay29.Options
+	state  *relay29.State
 }
 
 func (r *Relay) Name() string {
@@ -36,9 +40,36 @@ func (r *Relay) Storage(ctx context.Context) eventstore.Store {
 }
 
 func (r *Relay) AcceptEvent(ctx context.Context, ev *nostr.Event) (bool, string) {
+	if r.RejectFunc != nil {
+		if rejected, msg := r.RejectFunc(ev); rejected {
+			return false, msg
+		}
+	}
+	if rejected, msg := r.state.Pipeline.Reject(ctx, ev); rejected {
+		return false, msg
+	}
 	return true, ""
 }
 
+// ServiceURL makes relayer ask clients to authenticate, which they must do to read private groups
+func (r *Relay) ServiceURL() string {
+	return r.URL
+}
+
+// AcceptReq rejects the whole subscription with a CLOSED if any of its filters is rejected, so clients know they
+// must authenticate (relayer itself would only send a NOTICE)
+func (r *Relay) AcceptReq(ctx context.Context, id string, filters nostr.Filters, authedPubkey string) bool {
+	for _, filter := range filters {
+		if rejected, msg := r.state.Pipeline.RejectQuery(ctx, filter); rejected {
+			if ws, ok := ctx.Value(relayer.AUTH_CONTEXT_KEY).(*relayer.WebSocket); ok {
+				ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: msg})
+			}
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
 	if r.NIP11Info != nil {
 		return r.NIP11Info()
@@ -47,7 +78,7 @@ func (r *Relay) GetNIP11InformationDocument() nip11.RelayInformationDocument {
 	return nip11.RelayInformationDocument{
 		Name:          "nostr-relay29",
 		Description:   "relay29 rleay powered by the relayer framework",
-		SupportedNIPs: []any{29},
+		SupportedNIPs: []any{29, 40, 42, 45, 50},
 	}
 }
 
@@ -68,6 +99,7 @@ func Init(opts relay29.Options) (relayer.Relay, *relay29.State) {
 
 	// create a new khatru relay
 	relay := &Relay{
+		URL:    "wss://" + opts.Domain,
 		pubkey: pubkey,
 		state:  state,
 		opts:   opts,
@@ -76,6 +108,9 @@ func Init(opts relay29.Options) (relayer.Relay, *relay29.State) {
 	// assign khatru relay to relay29.State
 	state.Relay = relay
 
+	// identify ourselves in the audit log
+	state.Adapter = "relayer29"
+
 	// provide GetAuthed function
 	state.GetAuthed = func(ctx context.Context) string {
 		pubkey, _ := relayer.GetAuthStatus(ctx)
@@ -91,8 +126,10 @@ type Store struct {
 	store eventstore.Store
 }
 
+// Init does nothing as the database was already initialized and loaded by relay29.New, initializing it again could
+// wipe it
 func (s *Store) Init() error {
-	return s.store.Init()
+	return nil
 }
 
 func (s *Store) Close() {
@@ -100,66 +137,30 @@ func (s *Store) Close() {
 }
 
 func (s *Store) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	if rejected, msg := s.state.RequireKindAndSingleGroupIDOrSpecificEventReference(ctx, filter); rejected {
+	if rejected, msg := s.state.Pipeline.RejectQuery(ctx, filter); rejected {
 		return nil, errors.New(msg)
 	}
+	return s.state.Pipeline.Query(ctx, filter)
+}
 
-	rfs := []func(context.Context, nostr.Filter) (chan *nostr.Event, error){
-		s.state.NormalEventQuery,
-		s.state.MetadataQueryHandler,
-		s.state.AdminsQueryHandler,
-		s.state.MembersQueryHandler,
-		s.state.RolesQueryHandler,
+func (s *Store) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if rejected, msg := s.state.Pipeline.RejectQuery(ctx, filter); rejected {
+		return 0, errors.New(msg)
 	}
-	for _, rf := range rfs {
-		if evc, err := rf(ctx, filter); err == nil {
-			return evc, nil
-		}
-	}
-	return s.store.QueryEvents(ctx, filter)
+	return s.state.Pipeline.Count(ctx, filter)
 }
 
 func (s *Store) DeleteEvent(ctx context.Context, ev *nostr.Event) error {
-	return s.store.DeleteEvent(ctx, ev)
+	return s.state.Pipeline.Delete(ctx, ev)
 }
 
+// SaveEvent is only called by relayer after AcceptEvent, so the event was already checked
 func (s *Store) SaveEvent(ctx context.Context, ev *nostr.Event) error {
-	if s.relay.RejectFunc != nil {
-		if rejected, msg := s.relay.RejectFunc(ev); rejected {
-			return errors.New(msg)
-		}
-	}
-
-	bfs := []func(context.Context, *nostr.Event) (bool, string){
-		s.state.RequireHTagForExistingGroup,
-		s.state.RequireModerationEventsToBeRecent,
-		s.state.RestrictWritesBasedOnGroupRules,
-		s.state.RestrictInvalidModerationActions,
-		s.state.PreventWritingOfEventsJustDeleted,
-		s.state.CheckPreviousTag,
-	}
-	for _, rf := range bfs {
-		if rejected, msg := rf(ctx, ev); rejected {
-			return errors.New(msg)
-		}
-	}
-
-	err := s.store.SaveEvent(ctx, ev)
-	if err != nil {
+	if err := s.state.Pipeline.Store(ctx, ev); err != nil {
 		return err
 	}
-
-	afs := []func(context.Context, *nostr.Event){
-		s.state.ApplyModerationAction,
-		s.state.ReactToJoinRequest,
-		s.state.ReactToLeaveRequest,
-		s.state.AddToPreviousChecking,
-	}
-	for _, rf := range afs {
-		rf(ctx, ev)
-	}
-
-	return err
+	s.state.Pipeline.AfterSave(ctx, ev)
+	return nil
 }
 
 func (s *Store) ReplaceEvent(ctx context.Context, ev *nostr.Event) error {
@@ -0,0 +1,411 @@
+package relay29
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/rs/zerolog/log"
+)
+
+// a relay can follow another (the leader) and mirror everything it has, to be used as a hot standby. the follower
+// must be running with the same relay key as the leader, so the events signed by the relay stay valid and it can
+// be promoted to leader at any time. while following, writes from clients are refused and all the state is rebuilt
+// from the moderation events that come from the leader without checking permissions again (the leader did that).
+//
+// the leader needs nothing special: it recognizes the follower because it authenticates with the relay key and lets
+// it read everything.
+
+// ReplicationSource is where followers get events from.
+type ReplicationSource interface {
+	// Replicate sends all the events stored since the given time (oldest first) followed by all new events as they
+	// are saved, until ctx is canceled or the connection breaks, in which case the channel is closed.
+	Replicate(ctx context.Context, since nostr.Timestamp) (chan *nostr.Event, error)
+}
+
+// when reconnecting we ask for a little more than we need, duplicates are ignored
+const replicationOverlap = 60 * 5
+
+type replication struct {
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	following atomic.Bool
+	latest    atomic.Int64
+
+	// for local followers, see LocalReplicationSource
+	replicas map[chan *nostr.Event]struct{}
+}
+
+// Follow starts mirroring the source in the background, until Promote is called.
+func (s *State) Follow(source ReplicationSource) {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.replication.mu.Lock()
+	if s.replication.cancel != nil {
+		s.replication.cancel()
+	}
+	s.replication.cancel = cancel
+	s.replication.following.Store(true)
+	s.replication.mu.Unlock()
+
+	// resume from the newest event we already have
+	s.replication.latest.Store(int64(s.latestReplicated(ctx)))
+
+	s.background(func(context.Context) {
+		wait := time.Second
+		for ctx.Err() == nil {
+			since := nostr.Timestamp(0)
+			if latest := s.replication.latest.Load(); latest > replicationOverlap {
+				since = nostr.Timestamp(latest - replicationOverlap)
+			}
+
+			ch, err := source.Replicate(ctx, since)
+			if err == nil {
+				wait = time.Second
+				for evt := range ch {
+					s.ingestReplicated(ctx, evt)
+				}
+			} else {
+				log.Warn().Err(err).Msg("failed to replicate from leader")
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+				wait = min(wait*2, time.Minute)
+			}
+		}
+	})
+}
+
+// latestReplicated finds the newest event we have that could have come from the leader, the ones we generate
+// ourselves may be newer (if they were ever stored) but they say nothing about where we are.
+func (s *State) latestReplicated(ctx context.Context) nostr.Timestamp {
+	var until *nostr.Timestamp
+	for {
+		res, err := s.DB.QueryEvents(ctx, nostr.Filter{Until: until, Limit: 100})
+		if err != nil {
+			return 0
+		}
+		count := 0
+		oldest := nostr.Timestamp(0)
+		for evt := range res {
+			if !isGeneratedKind(evt.Kind) {
+				go func() {
+					for range res {
+					}
+				}()
+				return evt.CreatedAt
+			}
+			if count == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			count++
+		}
+		if count < 100 || oldest == 0 {
+			return 0
+		}
+		oldest--
+		until = &oldest
+	}
+}
+
+// Promote stops following and makes this relay accept writes from clients again.
+func (s *State) Promote() {
+	s.replication.mu.Lock()
+	defer s.replication.mu.Unlock()
+
+	if s.replication.cancel != nil {
+		s.replication.cancel()
+		s.replication.cancel = nil
+	}
+	s.replication.following.Store(false)
+}
+
+// IsFollower tells if this relay is currently following another.
+func (s *State) IsFollower() bool {
+	return s.replication.following.Load()
+}
+
+func (s *State) RejectWritesWhileFollowing(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if s.replication.following.Load() {
+		return true, "blocked: this relay is a read-only replica"
+	}
+	return false, ""
+}
+
+// we generate these ourselves
+func isGeneratedKind(kind int) bool {
+	return slices.Contains(nip29.MetadataEventKinds, kind) ||
+		kind == KindSimpleGroupMembersDelta ||
+		kind == KindSimpleGroupAuditEntry
+}
+
+// ingestReplicated does what would be done to an event published by a client, minus the checks.
+func (s *State) ingestReplicated(ctx context.Context, event *nostr.Event) {
+	if isGeneratedKind(event.Kind) {
+		return
+	}
+	if err := s.DB.SaveEvent(ctx, event); err != nil {
+		if err != eventstore.ErrDupEvent {
+			log.Warn().Err(err).Stringer("event", event).Msg("failed to save replicated event")
+		}
+		return
+	}
+	if latest := s.replication.latest.Load(); int64(event.CreatedAt) > latest {
+		s.replication.latest.Store(int64(event.CreatedAt))
+	}
+
+	if event.Kind == KindSimpleGroupSequence {
+		s.applyReplicatedSequence(ctx, event)
+	} else {
+		s.ApplyModerationAction(ctx, event)
+	}
+	s.AddToPreviousChecking(ctx, event)
+	s.ScheduleExpiration(ctx, event)
+	s.IndexForSearch(ctx, event)
+	s.AddToNegentropyIndex(ctx, event)
+	s.FeedReplicas(ctx, event)
+	s.PublishChange(ctx, event)
+	s.Relay.BroadcastEvent(event)
+}
+
+// applyReplicatedSequence applies the moderation event from a client that the leader says goes next.
+func (s *State) applyReplicatedSequence(ctx context.Context, record *nostr.Event) {
+	sequence := sequenceTag(record, s.publicKey)
+	etag := record.Tags.GetFirst([]string{"e", ""})
+	if sequence == 0 || etag == nil {
+		return
+	}
+	res, err := s.DB.QueryEvents(ctx, nostr.Filter{IDs: []string{(*etag)[1]}})
+	if err != nil {
+		return
+	}
+	for event := range res {
+		if !ModerationEventKinds.Includes(event.Kind) {
+			continue
+		}
+		s.applyChange(ctx, event, sequence)
+		s.PublishChange(ctx, event)
+	}
+}
+
+// FeedReplicas is meant to be called after events are saved, it's only needed for LocalReplicationSource.
+func (s *State) FeedReplicas(ctx context.Context, event *nostr.Event) {
+	s.replication.mu.Lock()
+	defer s.replication.mu.Unlock()
+
+	for ch := range s.replication.replicas {
+		select {
+		case ch <- event:
+		default:
+			// this follower is too slow, it will catch up when it reconnects
+			delete(s.replication.replicas, ch)
+			close(ch)
+		}
+	}
+}
+
+// LocalReplicationSource follows a State in the same process.
+type LocalReplicationSource struct {
+	Leader *State
+}
+
+func (src LocalReplicationSource) Replicate(ctx context.Context, since nostr.Timestamp) (chan *nostr.Event, error) {
+	leader := src.Leader
+
+	// listen before reading what is stored so nothing is lost in between
+	live := make(chan *nostr.Event, 500)
+	leader.replication.mu.Lock()
+	if leader.replication.replicas == nil {
+		leader.replication.replicas = make(map[chan *nostr.Event]struct{})
+	}
+	leader.replication.replicas[live] = struct{}{}
+	leader.replication.mu.Unlock()
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		defer leader.stopFeeding(live)
+
+		if err := replicationHistory(ctx, leader.DB.QueryEvents, since, leader.publicKey, ch); err != nil {
+			log.Warn().Err(err).Msg("failed to read replication history")
+			return
+		}
+		for {
+			select {
+			case evt, ok := <-live:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *State) stopFeeding(ch chan *nostr.Event) {
+	s.replication.mu.Lock()
+	defer s.replication.mu.Unlock()
+
+	if _, ok := s.replication.replicas[ch]; ok {
+		delete(s.replication.replicas, ch)
+		close(ch)
+	}
+}
+
+// RelayReplicationSource follows a relay29 relay over a websocket.
+type RelayReplicationSource struct {
+	URL       string
+	SecretKey string
+}
+
+func (src RelayReplicationSource) Replicate(ctx context.Context, since nostr.Timestamp) (chan *nostr.Event, error) {
+	relay, err := nostr.RelayConnect(ctx, src.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// the challenge comes right after we connect, but we may have to wait for it a little
+	for attempt := 0; ; attempt++ {
+		err = relay.Auth(ctx, func(evt *nostr.Event) error { return evt.Sign(src.SecretKey) })
+		if err == nil {
+			break
+		} else if attempt == 4 {
+			relay.Close()
+			return nil, fmt.Errorf("failed to authenticate to leader: %w", err)
+		}
+		time.Sleep(time.Millisecond * 200 * time.Duration(attempt+1))
+	}
+
+	// listen before reading what is stored so nothing is lost in between
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{LimitZero: true}})
+	if err != nil {
+		relay.Close()
+		return nil, err
+	}
+
+	pubkey, _ := nostr.GetPublicKey(src.SecretKey)
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		defer relay.Close()
+
+		if err := replicationHistory(ctx, relay.QueryEvents, since, pubkey, ch); err != nil {
+			log.Warn().Err(err).Msg("failed to read replication history from leader")
+			return
+		}
+		for {
+			select {
+			case evt, ok := <-sub.Events:
+				if !ok {
+					return
+				}
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			case reason := <-sub.ClosedReason:
+				log.Warn().Str("reason", reason).Msg("leader closed the replication subscription")
+				return
+			case <-relay.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// how many events we read at once when sending the history to a follower
+const replicationBatch = 500
+
+// replicationHistory sends all events stored since a time to ch, in the order they must be applied. they're read in
+// windows of time with up to replicationBatch events each (more only if they all have the same timestamp), which
+// is as much as we keep in memory.
+func replicationHistory(
+	ctx context.Context,
+	query func(context.Context, nostr.Filter) (chan *nostr.Event, error),
+	since nostr.Timestamp,
+	relayPubKey string,
+	ch chan *nostr.Event,
+) error {
+	window := nostr.Timestamp(60 * 60)
+	for from := since; ; {
+		end := from + window - 1
+		filter := nostr.Filter{Since: &from, Limit: replicationBatch}
+		last := end >= nostr.Now()
+		if !last {
+			filter.Until = &end
+		}
+
+		events := make([]*nostr.Event, 0, replicationBatch)
+		res, err := query(ctx, filter)
+		if err != nil {
+			return err
+		}
+		for evt := range res {
+			events = append(events, evt)
+		}
+
+		if len(events) >= replicationBatch {
+			if window > 1 {
+				// too many, we try again with less
+				window /= 2
+				continue
+			}
+			// all in the same second, so we have to take them all
+			last = false
+			events = events[:0]
+			if err := PageEvents(ctx, query, nostr.Filter{Since: &from, Until: &end}, func(evt *nostr.Event) {
+				events = append(events, evt)
+			}); err != nil {
+				return err
+			}
+		} else if len(events) < replicationBatch/4 {
+			window *= 2
+		}
+
+		// the leader applied them in this order, and each KindSimpleGroupSequence event comes after the one it talks
+		// about
+		events = slices.DeleteFunc(events, func(evt *nostr.Event) bool { return isGeneratedKind(evt.Kind) })
+		slices.SortFunc(events, func(a, b *nostr.Event) int {
+			return cmp.Or(
+				cmp.Compare(a.CreatedAt, b.CreatedAt),
+				cmp.Compare(sequenceTag(a, relayPubKey), sequenceTag(b, relayPubKey)),
+				cmp.Compare(a.ID, b.ID),
+			)
+		})
+		for _, evt := range events {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return errors.New("canceled")
+			}
+		}
+
+		if last {
+			return nil
+		}
+		from = end + 1
+	}
+}
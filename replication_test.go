@@ -0,0 +1,133 @@
+package relay29
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	leader := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	publish := func(state *State, content string) (*nostr.Event, error) {
+		evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: content, Tags: nostr.Tags{{"h", "a"}}}
+		evt.Sign(owner)
+		if rejected, msg := state.RejectWritesWhileFollowing(ctx, evt); rejected {
+			return nil, errorString(msg)
+		}
+		_, err := state.Relay.AddEvent(ctx, evt)
+		return evt, err
+	}
+
+	require.NoError(t, leader.CreateGroup(ctx, "a", ownerPk, EditMetadata{}))
+	require.NoError(t, leader.PutUser(ctx, "a", member))
+	before, err := publish(leader, "before")
+	require.NoError(t, err)
+
+	// the follower uses the same key
+	db := &MemoryStore{}
+	db.Init()
+	follower := New(Options{
+		Domain:                  leader.Domain,
+		DB:                      db,
+		SecretKey:               leader.secretKey,
+		DefaultRoles:            leader.defaultRoles,
+		GroupCreatorDefaultRole: leader.groupCreatorDefaultRole,
+	})
+	follower.GetAuthed = leader.GetAuthed
+	follower.AllowAction = leader.AllowAction
+	follower.Relay = testRelay{follower}
+	follower.Follow(LocalReplicationSource{leader})
+
+	leaderGroup, _ := leader.Groups.Load("a")
+	synced := func() bool {
+		group, _ := follower.Groups.Load("a")
+		return group != nil && group.Sequence() == leaderGroup.Sequence()
+	}
+
+	// history
+	require.Eventually(t, synced, time.Second, time.Millisecond*10)
+	group, _ := follower.Groups.Load("a")
+	require.Contains(t, group.Members, member)
+
+	// live (events come in order, so when the last moderation event arrives everything else is there too)
+	after, err := publish(leader, "after")
+	require.NoError(t, err)
+	require.NoError(t, leader.RemoveUserFromGroup(ctx, "a", member))
+	require.Eventually(t, synced, time.Second, time.Millisecond*10)
+	require.NotContains(t, group.Members, member)
+
+	res, _ := follower.DB.QueryEvents(ctx, nostr.Filter{Kinds: []int{9}})
+	ids := make([]string, 0, 2)
+	for evt := range res {
+		ids = append(ids, evt.ID)
+	}
+	require.ElementsMatch(t, []string{before.ID, after.ID}, ids)
+
+	// no writes while following
+	require.True(t, follower.IsFollower())
+	_, err = publish(follower, "nope")
+	require.Error(t, err)
+
+	// until promoted
+	follower.Promote()
+	require.False(t, follower.IsFollower())
+	_, err = publish(follower, "yes")
+	require.NoError(t, err)
+}
+
+func TestReplicationHistory(t *testing.T) {
+	ctx := context.Background()
+	db := &MemoryStore{MaxLimit: replicationBatch}
+	db.Init()
+
+	// more than fits in a batch, some all in the same second
+	author := nostr.GeneratePrivateKey()
+	start := nostr.Now() - 10000
+	stored := 0
+	for i := range 1500 {
+		evt := &nostr.Event{CreatedAt: start + nostr.Timestamp(i*5), Kind: 9, Content: "hi", Tags: nostr.Tags{{"h", "a"}}}
+		if i >= 1000 {
+			evt.CreatedAt = start + 6000
+			evt.Content = strconv.Itoa(i)
+		}
+		evt.Sign(author)
+		require.NoError(t, db.SaveEvent(ctx, evt))
+		stored++
+	}
+
+	// and something we generated that isn't sent
+	generated := &nostr.Event{CreatedAt: nostr.Now() + 100, Kind: nostr.KindSimpleGroupMetadata, Tags: nostr.Tags{{"d", "a"}}}
+	generated.Sign(author)
+	require.NoError(t, db.SaveEvent(ctx, generated))
+
+	ch := make(chan *nostr.Event)
+	received := make([]*nostr.Event, 0, stored)
+	done := make(chan error, 1)
+	go func() {
+		done <- replicationHistory(ctx, db.QueryEvents, start, "", ch)
+		close(ch)
+	}()
+	for evt := range ch {
+		received = append(received, evt)
+	}
+	require.NoError(t, <-done)
+	require.Len(t, received, stored)
+	for i := 1; i < len(received); i++ {
+		require.LessOrEqual(t, received[i-1].CreatedAt, received[i].CreatedAt)
+	}
+
+	// a follower resumes from the newest thing that came from the leader
+	state := New(Options{Domain: "localhost", DB: db, SecretKey: nostr.GeneratePrivateKey(), NoBackgroundWork: true})
+	defer state.Close()
+	require.Equal(t, start+6000, state.latestReplicated(ctx))
+}
@@ -0,0 +1,129 @@
+package relay29
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// RevertModerationAction undoes the moderation event with the given id on behalf of the relay.
+func (s *State) RevertModerationAction(ctx context.Context, groupId string, eventId string) error {
+	return s.applyEvents(ctx, &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      KindSimpleGroupRevert,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", groupId},
+			nostr.Tag{"e", eventId},
+		},
+	})
+}
+
+// prepareRevert looks at the moderation history of the group to figure out what must be done to undo the
+// event targeted by the given revert event. it returns that target event and the fully prepared Revert action.
+func (s *State) prepareRevert(ctx context.Context, event *nostr.Event) (*nostr.Event, Revert, error) {
+	groupId := GetGroupIDFromEvent(event)
+	events, _, err := s.moderationHistory(ctx, groupId)
+	if err != nil {
+		return nil, Revert{}, fmt.Errorf("failed to load moderation history: %w", err)
+	}
+
+	// if this revert was already stored we must not consider it part of the history yet
+	events = slices.DeleteFunc(events, func(evt *nostr.Event) bool { return evt.ID == event.ID })
+
+	action, err := PrepareModerationAction(event)
+	if err != nil {
+		return nil, Revert{}, err
+	}
+	revert, ok := action.(Revert)
+	if !ok {
+		return nil, Revert{}, fmt.Errorf("not a revert")
+	}
+
+	idx := slices.IndexFunc(events, func(evt *nostr.Event) bool { return evt.ID == revert.Target })
+	if idx == -1 {
+		return nil, Revert{}, fmt.Errorf("target is not a moderation event of this group")
+	}
+	target := events[idx]
+	if slices.ContainsFunc(events[idx+1:], func(evt *nostr.Event) bool {
+		return evt.Kind == KindSimpleGroupRevert && evt.Tags.GetFirst([]string{"e", target.ID}) != nil
+	}) {
+		return nil, Revert{}, fmt.Errorf("target was already reverted")
+	}
+
+	// replay everything with the revert at the end so it gets prepared just like it will be when we restart
+	scratch := s.NewGroup(groupId, events[0].PubKey)
+	actions, err := s.replayModerationEvents(scratch, append(events, event))
+	if err != nil {
+		return nil, Revert{}, err
+	}
+
+	revert = actions[len(actions)-1].(Revert)
+	if revert.Undo == nil {
+		return nil, Revert{}, fmt.Errorf("%s can't be reverted", actions[idx].Name())
+	}
+
+	return target, revert, nil
+}
+
+// outranks tells if the first pubkey has a higher role than the second in the given group.
+// roles are ranked by their order in the list of roles of the group and the relay outranks everybody.
+func (s *State) outranks(group nip29.Group, pubkey string, other string) bool {
+	return s.rank(group, pubkey) < s.rank(group, other)
+}
+
+func (s *State) rank(group nip29.Group, pubkey string) int {
+	if pubkey == s.publicKey {
+		return -1
+	}
+	best := len(group.Roles)
+	for _, role := range group.Members[pubkey] {
+		if idx := slices.Index(group.Roles, role); idx != -1 && idx < best {
+			best = idx
+		}
+	}
+	return best
+}
+
+// inverseOfSequence returns the actions that undo the given actions when they are applied in order
+// starting at the given state, or nil if any of them isn't reversible.
+func inverseOfSequence(actions []Action, before *Group, when nostr.Timestamp) []Action {
+	current := before.snapshot()
+	inverse := make([]Action, 0, len(actions))
+	for _, action := range actions {
+		reversible, ok := action.(ReversibleAction)
+		if !ok {
+			return nil
+		}
+		inverse = append(reversible.Inverse(current, when), inverse...)
+		current.applyAction(action)
+	}
+	return inverse
+}
+
+// snapshot copies the parts of a group that come from moderation events, see cloneGroup.
+func (group *Group) snapshot() *Group {
+	return &Group{
+		Group:     cloneGroup(group.Group),
+		Topics:    slices.Clone(group.Topics),
+		Language:  group.Language,
+		MovedTo:   group.MovedTo,
+		createdAt: group.createdAt,
+	}
+}
+
+// cloneGroup copies a group deeply enough that applying actions to the copy doesn't affect the original.
+func cloneGroup(group nip29.Group) nip29.Group {
+	group.Members = maps.Clone(group.Members)
+	if group.Members == nil {
+		group.Members = make(map[string][]*nip29.Role)
+	}
+	for pubkey, roles := range group.Members {
+		group.Members[pubkey] = slices.Clone(roles)
+	}
+	group.Roles = slices.Clone(group.Roles)
+	return group
+}
@@ -0,0 +1,132 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+// testRelay runs the same pipeline khatru29 would, but without any networking and with only the checks that don't
+// depend on the time
+type testRelay struct {
+	state *State
+}
+
+func (r testRelay) BroadcastEvent(*nostr.Event) {}
+
+func (r testRelay) AddEvent(ctx context.Context, event *nostr.Event) (skipBroadcast bool, writeError error) {
+	for _, reject := range []func(context.Context, *nostr.Event) (bool, string){
+		r.state.RequireHTagForExistingGroup,
+		r.state.RestrictWritesBasedOnGroupRules,
+		r.state.RestrictInvalidModerationActions,
+		r.state.RequireModerationEventsInSequence,
+	} {
+		if rejected, msg := reject(ctx, event); rejected {
+			return false, errorString(msg)
+		}
+	}
+	if err := r.state.Pipeline.Store(ctx, event); err != nil {
+		return false, err
+	}
+	r.state.Pipeline.AfterSave(ctx, event)
+	return false, nil
+}
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
+
+func newTestState() *State {
+	db := &MemoryStore{MaxLimit: 2000} // so tests can have more than a page of events in the same second
+	db.Init()
+
+	owner := &nip29.Role{Name: "owner"}
+	moderator := &nip29.Role{Name: "moderator"}
+	state := New(Options{
+		Domain:                  "localhost",
+		DB:                      db,
+		SecretKey:               nostr.GeneratePrivateKey(),
+		DefaultRoles:            []*nip29.Role{owner, moderator},
+		GroupCreatorDefaultRole: owner,
+	})
+	state.GetAuthed = func(context.Context) string { return "" }
+	state.AllowAction = func(ctx context.Context, group nip29.Group, role *nip29.Role, action Action) bool {
+		return role == owner || role == moderator
+	}
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool {
+		return role == owner || role == moderator
+	}
+	state.Relay = testRelay{state}
+
+	return state
+}
+
+func TestRevert(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	moderator := nostr.GeneratePrivateKey()
+	moderatorPk, _ := nostr.GetPublicKey(moderator)
+	memberPk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	// moderation events are replayed in timestamp order so we can't have them all in the same second
+	now := nostr.Now() - 100
+	publish := func(signer string, evt *nostr.Event) error {
+		now++
+		evt.CreatedAt = now
+		evt.Sign(signer)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		return err
+	}
+
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "r"}}}))
+	require.NoError(t, publish(owner, &nostr.Event{
+		Kind: nostr.KindSimpleGroupPutUser,
+		Tags: nostr.Tags{{"h", "r"}, {"p", moderatorPk, "moderator"}, {"p", memberPk, "moderator"}},
+	}))
+
+	rename := &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "r"}, {"about", "wrong"}}}
+	require.NoError(t, publish(owner, rename))
+
+	remove := &nostr.Event{Kind: nostr.KindSimpleGroupRemoveUser, Tags: nostr.Tags{{"h", "r"}, {"p", memberPk}}}
+	require.NoError(t, publish(moderator, remove))
+
+	group, _ := state.Groups.Load("r")
+	require.NotContains(t, group.Members, memberPk)
+
+	// the moderator can't undo what the owner did
+	require.Error(t, publish(moderator, &nostr.Event{Kind: KindSimpleGroupRevert, Tags: nostr.Tags{{"h", "r"}, {"e", rename.ID}}}))
+
+	// but the owner can undo what the moderator did and the previous roles are restored
+	revert := &nostr.Event{Kind: KindSimpleGroupRevert, Tags: nostr.Tags{{"h", "r"}, {"e", remove.ID}}}
+	require.NoError(t, publish(owner, revert))
+	require.Contains(t, group.Members, memberPk)
+	require.Equal(t, "moderator", group.Members[memberPk][0].Name)
+
+	// which can't be done twice
+	require.Error(t, publish(owner, &nostr.Event{Kind: KindSimpleGroupRevert, Tags: nostr.Tags{{"h", "r"}, {"e", remove.ID}}}))
+
+	// edits without any metadata only come from the relay itself
+	require.ErrorContains(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "r"}}}), "missing metadata tags")
+
+	// topics and language come back too
+	require.NoError(t, publish(owner, &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "r"}, {"t", "hiking"}, {"l", "pt"}}}))
+	retag := &nostr.Event{Kind: nostr.KindSimpleGroupEditMetadata, Tags: nostr.Tags{{"h", "r"}, {"t", "cooking"}, {"l", "en"}}}
+	require.NoError(t, publish(owner, retag))
+	require.NoError(t, publish(owner, &nostr.Event{Kind: KindSimpleGroupRevert, Tags: nostr.Tags{{"h", "r"}, {"e", retag.ID}}}))
+	require.Equal(t, []string{"hiking"}, group.Topics)
+	require.Equal(t, "pt", group.Language)
+
+	// the relay can revert anything
+	require.NoError(t, state.RevertModerationAction(ctx, "r", rename.ID))
+	require.Equal(t, "", group.About)
+
+	// and the reconstructed state matches the live state
+	rebuilt, err := state.GroupAt(ctx, "r", nostr.Now()+10)
+	require.NoError(t, err)
+	require.True(t, DiffGroups(group, rebuilt).IsEmpty())
+}
@@ -0,0 +1,256 @@
+package relay29
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog/log"
+)
+
+// SearchIndex is used for answering NIP-50 queries for the events inside groups, like
+// {"kinds": [9], "#h": ["<group>"], "search": "something"}. it's fed from the save hooks and the deletions.
+type SearchIndex interface {
+	Index(ctx context.Context, groupId string, event *nostr.Event) error
+	Remove(ctx context.Context, id string) error
+
+	// Search returns the ids of the events that match the query in one of the given groups, best matches first.
+	// since and until (which may be nil) must be applied before the limit.
+	Search(ctx context.Context, groupIds []string, query string, since, until *nostr.Timestamp, limit int) ([]string, error)
+}
+
+// IndexForSearch is meant to be called after events are saved.
+func (s *State) IndexForSearch(ctx context.Context, event *nostr.Event) {
+	if s.SearchIndex == nil || event.Content == "" || ModerationEventKinds.Includes(event.Kind) {
+		return
+	}
+	gtag := event.Tags.GetFirst([]string{"h", ""})
+	if gtag == nil {
+		return
+	}
+	if err := s.SearchIndex.Index(ctx, (*gtag)[1], event); err != nil {
+		log.Warn().Err(err).Stringer("event", event).Msg("failed to index event for search")
+	}
+}
+
+// RemoveFromSearchIndex is meant to be called when events are deleted.
+func (s *State) RemoveFromSearchIndex(ctx context.Context, event *nostr.Event) error {
+	if s.SearchIndex == nil {
+		return nil
+	}
+	return s.SearchIndex.Remove(ctx, event.ID)
+}
+
+// searchQuery answers a filter with "search" and "h" tags. the groups must already have been checked by
+// RequireKindAndSingleGroupIDOrSpecificEventReference.
+func (s *State) searchQuery(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+	if s.SearchIndex == nil {
+		close(ch)
+		return ch, nil
+	}
+
+	limit := filter.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 500
+	}
+
+	ids, err := s.SearchIndex.Search(ctx, filter.Tags["h"], filter.Search, filter.Since, filter.Until, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	authed := s.GetAuthed(ctx)
+	go func() {
+		defer close(ch)
+		if len(ids) == 0 {
+			return
+		}
+
+		results, err := s.DB.QueryEvents(ctx, nostr.Filter{IDs: ids})
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to load search results")
+			return
+		}
+
+		// the rest of the filter still applies (but not the search, the database wouldn't know what to do with it)
+		rest := filter
+		rest.Search = ""
+
+		now := nostr.Now()
+		found := make(map[string]*nostr.Event, len(ids))
+		for evt := range results {
+			if isExpired(evt, now) || !rest.Matches(evt) {
+				continue
+			}
+			if group := s.GetGroupFromEvent(evt); group == nil || !s.canRead(group, authed) {
+				continue
+			}
+			found[evt.ID] = evt
+		}
+
+		// in the order the index gave us
+		for _, id := range ids {
+			if evt, ok := found[id]; ok {
+				select {
+				case ch <- evt:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// canRead tells if someone can read the events of a group.
+func (s *State) canRead(group *Group, authed string) bool {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+
+	if !group.Private {
+		return true
+	}
+	_, isMember := group.Members[authed]
+	return authed != "" && isMember
+}
+
+// buildSearchIndex feeds the index with all the events we have, it's used when the index is kept in memory.
+func (s *State) buildSearchIndex(ctx context.Context) {
+	for id := range s.Groups.Range {
+		if ctx.Err() != nil {
+			return
+		}
+		s.eachGroupEvent(ctx, id, func(evt *nostr.Event) {
+			s.IndexForSearch(ctx, evt)
+		})
+	}
+}
+
+// MemorySearchIndex is the SearchIndex we use when Options.EnableSearch is set. it's a simple inverted index kept in memory, so it's
+// rebuilt from the database on startup.
+type MemorySearchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]map[string]struct{} // group -> term -> ids
+	docs     map[string]indexedDocument
+}
+
+type indexedDocument struct {
+	group     string
+	terms     []string
+	createdAt nostr.Timestamp
+}
+
+var _ SearchIndex = (*MemorySearchIndex)(nil)
+
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{
+		postings: make(map[string]map[string]map[string]struct{}),
+		docs:     make(map[string]indexedDocument),
+	}
+}
+
+func searchTerms(text string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	slices.Sort(terms)
+	return slices.Compact(terms)
+}
+
+func (idx *MemorySearchIndex) Index(ctx context.Context, groupId string, event *nostr.Event) error {
+	terms := searchTerms(event.Content)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.docs[event.ID]; ok {
+		return nil
+	}
+	idx.docs[event.ID] = indexedDocument{groupId, terms, event.CreatedAt}
+
+	postings, ok := idx.postings[groupId]
+	if !ok {
+		postings = make(map[string]map[string]struct{})
+		idx.postings[groupId] = postings
+	}
+	for _, term := range terms {
+		if postings[term] == nil {
+			postings[term] = make(map[string]struct{}, 1)
+		}
+		postings[term][event.ID] = struct{}{}
+	}
+
+	return nil
+}
+
+func (idx *MemorySearchIndex) Remove(ctx context.Context, id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	doc, ok := idx.docs[id]
+	if !ok {
+		return nil
+	}
+	delete(idx.docs, id)
+
+	postings := idx.postings[doc.group]
+	for _, term := range doc.terms {
+		delete(postings[term], id)
+		if len(postings[term]) == 0 {
+			delete(postings, term)
+		}
+	}
+
+	return nil
+}
+
+func (idx *MemorySearchIndex) Search(
+	ctx context.Context,
+	groupIds []string,
+	query string,
+	since, until *nostr.Timestamp,
+	limit int,
+) ([]string, error) {
+	// NIP-50 extensions are ignored since we don't support any
+	words := strings.Fields(query)
+	words = slices.DeleteFunc(words, func(word string) bool { return strings.Contains(word, ":") })
+	terms := searchTerms(strings.Join(words, " "))
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// every term must be present, newest events first
+	matches := make([]string, 0, limit)
+	for _, groupId := range groupIds {
+		postings := idx.postings[groupId]
+	candidates:
+		for id := range postings[terms[0]] {
+			for _, term := range terms[1:] {
+				if _, ok := postings[term][id]; !ok {
+					continue candidates
+				}
+			}
+			if createdAt := idx.docs[id].createdAt; (since != nil && createdAt < *since) || (until != nil && createdAt > *until) {
+				continue
+			}
+			matches = append(matches, id)
+		}
+	}
+
+	slices.SortFunc(matches, func(a, b string) int {
+		return cmp.Or(cmp.Compare(idx.docs[b].createdAt, idx.docs[a].createdAt), cmp.Compare(a, b))
+	})
+	if len(matches) > limit {
+		matches = matches[0:limit]
+	}
+	return matches, nil
+}
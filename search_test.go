@@ -0,0 +1,85 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+	state.SearchIndex = NewMemorySearchIndex()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	stranger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	yes := true
+
+	require.NoError(t, state.CreateGroup(ctx, "pub", ownerPk, EditMetadata{}))
+	require.NoError(t, state.CreateGroup(ctx, "priv", ownerPk, EditMetadata{PrivateValue: &yes}))
+
+	post := func(group string, content string) *nostr.Event {
+		evt := &nostr.Event{CreatedAt: nostr.Now(), Kind: 9, Content: content, Tags: nostr.Tags{{"h", group}}}
+		evt.Sign(owner)
+		_, err := state.Relay.AddEvent(ctx, evt)
+		require.NoError(t, err)
+		return evt
+	}
+	old := &nostr.Event{CreatedAt: nostr.Now() - 100, Kind: 9, Content: "old world", Tags: nostr.Tags{{"h", "pub"}}}
+	old.Sign(owner)
+	require.NoError(t, state.DB.SaveEvent(ctx, old))
+	state.IndexForSearch(ctx, old)
+	hello := post("pub", "Hello, world!")
+	post("pub", "goodbye world")
+	post("priv", "hello from the secret place")
+
+	search := func(authed string, query string, groups ...string) []string {
+		state.GetAuthed = func(context.Context) string { return authed }
+		ch, err := state.NormalEventQuery(ctx, nostr.Filter{Kinds: []int{9}, Search: query, Tags: nostr.TagMap{"h": groups}})
+		require.NoError(t, err)
+		contents := make([]string, 0, 2)
+		for evt := range ch {
+			contents = append(contents, evt.Content)
+		}
+		return contents
+	}
+
+	require.Equal(t, []string{"Hello, world!"}, search("", "hello", "pub"))
+	require.Len(t, search("", "world", "pub"), 3)
+	require.Equal(t, []string{"goodbye world"}, search("", "WORLD goodbye", "pub"))
+	require.Empty(t, search("", "nothing", "pub"))
+
+	// private groups are only searchable by members
+	require.Empty(t, search(stranger, "hello", "priv"))
+	require.Equal(t, []string{"hello from the secret place"}, search(ownerPk, "hello", "priv"))
+
+	// the time range is applied before the limit
+	before := hello.CreatedAt - 1
+	state.GetAuthed = func(context.Context) string { return "" }
+	ch, err := state.NormalEventQuery(ctx, nostr.Filter{Kinds: []int{9}, Search: "world", Until: &before, Limit: 1, Tags: nostr.TagMap{"h": {"pub"}}})
+	require.NoError(t, err)
+	require.Equal(t, "old world", (<-ch).Content)
+
+	// deleted events are gone from the index
+	require.NoError(t, state.DeleteEvent(ctx, "pub", hello.ID))
+	require.Empty(t, search("", "hello", "pub"))
+
+	// and the default index is rebuilt on startup
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+		EnableSearch:            true,
+	})
+	defer restarted.Close()
+	require.Eventually(t, func() bool {
+		ids, _ := restarted.SearchIndex.Search(ctx, []string{"pub", "priv"}, "world", nil, nil, 10)
+		return len(ids) == 2
+	}, time.Second, 10*time.Millisecond)
+}
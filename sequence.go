@@ -0,0 +1,212 @@
+package relay29
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog/log"
+)
+
+// every moderation event gets the next number in the sequence of its group when it is applied, and the moderation
+// history is always replayed in that order, so we end up with the same state we had live no matter what timestamps
+// the events have. the events we generate ourselves carry their number in a "sequence" tag. we can't touch the
+// events that come from clients, so for those we store a KindSimpleGroupSequence event next to them saying where
+// they go.
+//
+// events that don't have a number at all come from before we did this and are replayed first, in the order of
+// their timestamps, like it used to be. the creation of a group always goes before anything else, as the ones we
+// generate in the name of the creator (see createGroupEvents) can't be signed by us and so their number doesn't
+// count.
+
+// KindSimpleGroupSequence is an event the relay stores after applying a moderation event from a client, with the
+// id of that event in an "e" tag and its position in the group history in a "sequence" tag.
+const KindSimpleGroupSequence = 9012
+
+// sequenceTag reads the "sequence" tag of an event, only the relay can say where its events go, so it is ignored on
+// anyone else's events (otherwise they could put them after events we apply later).
+func sequenceTag(event *nostr.Event, relayPubKey string) int64 {
+	if event.PubKey != relayPubKey {
+		return 0
+	}
+	if tag := event.Tags.GetFirst([]string{"sequence", ""}); tag != nil {
+		sequence, _ := strconv.ParseInt((*tag)[1], 10, 64)
+		return sequence
+	}
+	return 0
+}
+
+// sequenceModerationEvents takes the moderation events of a group plus the KindSimpleGroupSequence events that go
+// with them (in any order) and returns the moderation events in the order they must be replayed, along with the
+// sequence of the group after all of them.
+func sequenceModerationEvents(events []*nostr.Event, relayPubKey string) ([]*nostr.Event, int64) {
+	var last int64
+	positions := make(map[string]int64, len(events))
+	moderation := make([]*nostr.Event, 0, len(events))
+	for _, evt := range events {
+		sequence := sequenceTag(evt, relayPubKey)
+		last = max(last, sequence)
+
+		if evt.Kind != KindSimpleGroupSequence {
+			moderation = append(moderation, evt)
+			if sequence != 0 {
+				positions[evt.ID] = sequence
+			}
+		} else if tag := evt.Tags.GetFirst([]string{"e", ""}); tag != nil && sequence != 0 {
+			// when an event is applied again after its group was rebuilt (see ReloadGroup) it gets a new number
+			positions[(*tag)[1]] = max(positions[(*tag)[1]], sequence)
+		}
+	}
+
+	// events without a number that are newer than the first one that has one were stored but never applied (we
+	// must have stopped right in between), so they're left out
+	var firstSequenced nostr.Timestamp
+	for _, evt := range moderation {
+		if _, ok := positions[evt.ID]; ok && (firstSequenced == 0 || evt.CreatedAt < firstSequenced) {
+			firstSequenced = evt.CreatedAt
+		}
+	}
+	moderation = slices.DeleteFunc(moderation, func(evt *nostr.Event) bool {
+		if _, ok := positions[evt.ID]; ok || firstSequenced == 0 || evt.CreatedAt <= firstSequenced ||
+			evt.Kind == nostr.KindSimpleGroupCreateGroup {
+			return false
+		}
+		log.Warn().Stringer("event", evt).Msg("moderation event was never sequenced, ignoring it")
+		return true
+	})
+
+	creation := func(evt *nostr.Event) int {
+		if evt.Kind == nostr.KindSimpleGroupCreateGroup {
+			return 0
+		}
+		return 1
+	}
+	slices.SortFunc(moderation, func(a, b *nostr.Event) int {
+		return cmp.Or(
+			cmp.Compare(positions[a.ID], positions[b.ID]),
+			cmp.Compare(creation(a), creation(b)),
+			cmp.Compare(a.CreatedAt, b.CreatedAt),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+	return moderation, last
+}
+
+// Sequence is the number of the last moderation event that was applied to this group.
+func (group *Group) Sequence() int64 {
+	group.mu.RLock()
+	defer group.mu.RUnlock()
+	return group.sequence
+}
+
+// RequireModerationEventsInSequence rejects moderation events that try to say where they go in the group history,
+// only the relay decides that.
+func (s *State) RequireModerationEventsInSequence(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if !ModerationEventKinds.Includes(event.Kind) {
+		return false, ""
+	}
+
+	if event.PubKey != s.publicKey && event.Tags.GetFirst([]string{"sequence", ""}) != nil {
+		return true, "invalid: the sequence tag is reserved for the relay"
+	}
+
+	return false, ""
+}
+
+// canApply tells if a moderation event from a client can be applied to the groups we have: creations only when the
+// group doesn't exist and everything else only when it does. it must be called with moderationMu held.
+func (s *State) canApply(event *nostr.Event) bool {
+	group := s.GetGroupFromEvent(event)
+	return (event.Kind == nostr.KindSimpleGroupCreateGroup) == (group == nil)
+}
+
+// nextSequence reserves the next number in the sequence of a group for a moderation event from a client and stores
+// the KindSimpleGroupSequence event that records it. if other processes got there first the group is rebuilt and
+// false is returned when the event can't be applied anymore. it must be called with moderationMu held.
+func (s *State) nextSequence(ctx context.Context, event *nostr.Event) (int64, bool) {
+	groupId := GetGroupIDFromEvent(event)
+
+	var current int64
+	if group := s.GetGroupFromEvent(event); group != nil {
+		current = group.Sequence()
+	}
+	if s.groupStore != nil {
+		for {
+			ok, err := s.groupStore.Advance(ctx, groupId, current, current+1)
+			if err != nil {
+				log.Warn().Err(err).Str("group", groupId).Msg("failed to advance group sequence")
+				break
+			}
+			if ok {
+				break
+			}
+
+			// we go after whatever the others did
+			shared, err := s.groupStore.Sequence(ctx, groupId)
+			if err != nil {
+				log.Warn().Err(err).Str("group", groupId).Msg("failed to get group sequence")
+				break
+			}
+			s.resyncGroup(ctx, groupId)
+			if !s.canApply(event) {
+				return 0, false
+			}
+			current = shared
+		}
+	}
+	sequence := current + 1
+
+	// a follower gets this from the leader
+	if !s.replication.following.Load() {
+		s.storeSequenceEvent(ctx, event, sequence)
+	}
+
+	return sequence, true
+}
+
+// storeSequenceEvent stores the KindSimpleGroupSequence event saying where a moderation event goes.
+func (s *State) storeSequenceEvent(ctx context.Context, event *nostr.Event, sequence int64) {
+	record := &nostr.Event{
+		CreatedAt: max(nostr.Now(), event.CreatedAt),
+		Kind:      KindSimpleGroupSequence,
+		Tags: nostr.Tags{
+			{"h", GetGroupIDFromEvent(event)},
+			{"e", event.ID},
+			{"sequence", strconv.FormatInt(sequence, 10)},
+		},
+	}
+	if err := record.Sign(s.secretKey); err != nil {
+		log.Error().Err(err).Stringer("event", event).Msg("failed to sign sequence event")
+		return
+	}
+
+	ourCtx := context.WithValue(ctx, internalCallContextKey, struct{}{})
+	if err := s.Pipeline.Store(ourCtx, record); err != nil {
+		// it will be left out when the group is rebuilt
+		log.Error().Err(err).Stringer("event", event).Msg("failed to store sequence event")
+		return
+	}
+	s.Pipeline.AfterSave(ourCtx, record)
+	s.Relay.BroadcastEvent(record)
+}
+
+// stampSequence gives the events we're about to generate ourselves sequence numbers that place them after everything
+// that was already applied to their groups. it must be called with moderationMu held.
+func (s *State) stampSequence(events []*nostr.Event) {
+	sequences := make(map[string]int64, 1)
+	for _, evt := range events {
+		groupId := GetGroupIDFromEvent(evt)
+		sequence, ok := sequences[groupId]
+		if !ok {
+			if group, _ := s.Groups.Load(groupId); group != nil {
+				sequence = group.Sequence()
+			}
+		}
+
+		sequence++
+		sequences[groupId] = sequence
+		evt.Tags = append(evt.Tags, nostr.Tag{"sequence", strconv.FormatInt(sequence, 10)})
+	}
+}
@@ -0,0 +1,153 @@
+package relay29
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayMatchesLiveState(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	user1, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	user2, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	require.NoError(t, state.CreateGroup(ctx, "s", ownerPk, EditMetadata{}))
+
+	// lots of relay-generated changes in the same second
+	for range 5 {
+		require.NoError(t, state.PutUser(ctx, "s", user1))
+		require.NoError(t, state.RemoveUserFromGroup(ctx, "s", user1))
+		require.NoError(t, state.PutUser(ctx, "s", user2, "moderator"))
+		require.NoError(t, state.PutUser(ctx, "s", user1, "moderator"))
+		require.NoError(t, state.RemoveUserFromGroup(ctx, "s", user2))
+	}
+
+	// a client moderation event with a timestamp that would put it before these goes after them anyway
+	late := &nostr.Event{
+		CreatedAt: nostr.Now() - 60,
+		Kind:      nostr.KindSimpleGroupPutUser,
+		Tags:      nostr.Tags{{"h", "s"}, {"p", user2}},
+	}
+	late.Sign(owner)
+	_, err := state.Relay.AddEvent(ctx, late)
+	require.NoError(t, err)
+	require.Contains(t, state.Memberships(user2), "s")
+
+	// a fresh state built from the same database must end up with the same groups
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+	})
+	group, _ := state.Groups.Load("s")
+	rebuilt, _ := restarted.Groups.Load("s")
+	require.Contains(t, rebuilt.Members, user2)
+	require.True(t, DiffGroups(group, rebuilt).IsEmpty(), "%v", DiffGroups(group, rebuilt))
+	require.Equal(t, group.Sequence(), rebuilt.Sequence())
+}
+
+func TestSequenceOnlyFromRelay(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner := nostr.GeneratePrivateKey()
+	ownerPk, _ := nostr.GetPublicKey(owner)
+	user1, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	require.NoError(t, state.CreateGroup(ctx, "s", ownerPk, EditMetadata{}))
+
+	// clients can't say where their events go
+	jumpy := &nostr.Event{
+		CreatedAt: nostr.Now() + 1,
+		Kind:      nostr.KindSimpleGroupPutUser,
+		Tags:      nostr.Tags{{"h", "s"}, {"p", user1}, {"sequence", "9223372036854775807"}},
+	}
+	jumpy.Sign(owner)
+	reject, msg := state.RequireModerationEventsInSequence(ctx, jumpy)
+	require.True(t, reject)
+	require.Contains(t, msg, "sequence")
+
+	// and if one gets in anyway the tag is ignored, so what we do after it stays after it
+	require.NoError(t, state.DB.SaveEvent(ctx, jumpy))
+	state.ApplyModerationAction(ctx, jumpy)
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "s", user1))
+	history, _, err := state.moderationHistory(ctx, "s")
+	require.NoError(t, err)
+	require.Equal(t, nostr.KindSimpleGroupRemoveUser, history[len(history)-1].Kind)
+
+	// moderation events are replayed in the order they were applied, not in the order of their timestamps
+	late := &nostr.Event{
+		CreatedAt: nostr.Now() - 60,
+		Kind:      nostr.KindSimpleGroupPutUser,
+		Tags:      nostr.Tags{{"h", "s"}, {"p", user1}},
+	}
+	late.Sign(owner)
+	require.NoError(t, state.DB.SaveEvent(ctx, late))
+	state.ApplyModerationAction(ctx, late)
+	require.Contains(t, state.Memberships(user1), "s")
+
+	// the group is what we get from the database
+	group, _ := state.Groups.Load("s")
+	history, sequence, err := state.moderationHistory(ctx, "s")
+	require.NoError(t, err)
+	require.Equal(t, late.ID, history[len(history)-1].ID)
+	fresh, err := state.groupFromHistory("s", ownerPk, history, sequence)
+	require.NoError(t, err)
+	require.True(t, DiffGroups(group, fresh).IsEmpty(), "%v", DiffGroups(group, fresh))
+	require.Equal(t, fresh.Sequence(), group.Sequence())
+}
+
+func TestSequenceSurvivesMissingEvents(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	ownerPk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	require.NoError(t, state.CreateGroup(ctx, "s", ownerPk, EditMetadata{}))
+
+	// more than fits in a page
+	users := make([]string, 600)
+	for i := range users {
+		users[i], _ = nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		require.NoError(t, state.PutUser(ctx, "s", users[i]))
+	}
+	group, _ := state.Groups.Load("s")
+	sequence := group.Sequence()
+
+	// the numbers given out before stay taken even if the events that got them are gone
+	history, _, err := state.moderationHistory(ctx, "s")
+	require.NoError(t, err)
+	require.Len(t, history, 601)
+	require.NoError(t, state.DB.DeleteEvent(ctx, history[5]))
+
+	restarted := New(Options{
+		Domain:                  state.Domain,
+		DB:                      state.DB,
+		SecretKey:               state.secretKey,
+		DefaultRoles:            state.defaultRoles,
+		GroupCreatorDefaultRole: state.groupCreatorDefaultRole,
+	})
+	rebuilt, _ := restarted.Groups.Load("s")
+	require.Len(t, rebuilt.Members, 600)
+	require.Equal(t, sequence, rebuilt.Sequence())
+}
+
+// saveSequenced writes a moderation event from a client straight to the database along with its place in the
+// history, like another process would.
+func saveSequenced(t *testing.T, state *State, event *nostr.Event, sequence int64) {
+	record := &nostr.Event{
+		CreatedAt: event.CreatedAt,
+		Kind:      KindSimpleGroupSequence,
+		Tags:      nostr.Tags{{"h", GetGroupIDFromEvent(event)}, {"e", event.ID}, {"sequence", strconv.FormatInt(sequence, 10)}},
+	}
+	require.NoError(t, record.Sign(state.secretKey))
+	require.NoError(t, state.DB.SaveEvent(context.Background(), event))
+	require.NoError(t, state.DB.SaveEvent(context.Background(), record))
+}
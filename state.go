@@ -3,6 +3,8 @@ package relay29
 import (
 	"context"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/fiatjaf/eventstore"
 	"github.com/fiatjaf/set"
@@ -17,19 +19,59 @@ type State struct {
 	DB     eventstore.Store
 	Relay  interface {
 		BroadcastEvent(*nostr.Event)
+
+		// AddEvent isn't used anymore, the events we generate go through the Pipeline, it's only here so the
+		// relays that were set here before still fit
 		AddEvent(context.Context, *nostr.Event) (skipBroadcast bool, writeError error)
 	}
 	GetAuthed func(context.Context) string
 
 	AllowPrivateGroups bool
 
+	// Adapter is the name of the relay framework this is running on, it's only used in the audit log
+	Adapter string
+
+	// AuditLogWriter, if set, gets every audit log entry as a JSON line as soon as it happens -- otherwise the audit
+	// log is only kept in memory and is lost on restart
+	AuditLogWriter io.Writer
+
+	// SearchIndex is used for NIP-50 searches inside groups, see search.go
+	SearchIndex SearchIndex
+
+	// MaxFeedGroups is the maximum number of groups a query across groups will look into (0 disables these queries),
+	// see feeds.go
+	MaxFeedGroups int
+
+	// Pipeline is what the adapters do with events and filters, see pipeline.go
+	Pipeline *Pipeline
+
+	moderationMu            sync.Mutex
+	audit                   *auditLog
+	memberships             *membershipIndex
+	metadataCache           metadataCacheCounters
 	deletedCache            set.Set[string]
+	expiration              *expirationScheduler
 	publicKey               string
 	secretKey               string
 	defaultRoles            []*nip29.Role
 	groupCreatorDefaultRole *nip29.Role
+	fullMembersListLimit    int
+	replication             replication
+	groupStore              GroupStore
+	changeBus               ChangeBus
+	instance                string
+
+	// everything we do in the background stops when this is canceled, see Close
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
 
 	AllowAction func(ctx context.Context, group nip29.Group, role *nip29.Role, action Action) bool
+
+	// IsAdminRole tells if members with a role should be listed as admins of a group -- if not set every member
+	// with a role is an admin. it's called while the group is locked, so it must only look at the role (and not
+	// call AllowAction, for example)
+	IsAdminRole func(group nip29.Group, role *nip29.Role) bool
 }
 
 type Options struct {
@@ -38,15 +80,78 @@ type Options struct {
 	SecretKey               string
 	DefaultRoles            []*nip29.Role
 	GroupCreatorDefaultRole *nip29.Role
+
+	// AuditLogSize is the number of audit log entries we keep in memory (defaults to 10000)
+	AuditLogSize int
+
+	// FullMembersListLimit is the number of members above which we stop broadcasting the full list of members
+	// of a group (kind 39002) every time it changes, only the deltas (kind 9013) -- 0 means no limit
+	FullMembersListLimit int
+
+	// SearchIndex enables NIP-50 searches inside groups, EnableSearch does the same with a MemorySearchIndex (which
+	// is filled with everything from the database on startup) -- without any of these there is no search
+	SearchIndex  SearchIndex
+	EnableSearch bool
+
+	// GroupStore and ChangeBus must be given when many processes share the same database, see cluster.go
+	GroupStore GroupStore
+	ChangeBus  ChangeBus
+
+	// NoBackgroundWork is for tools that open the database while the relay is stopped: expired events aren't deleted
+	// and the search index from EnableSearch isn't filled
+	NoBackgroundWork bool
 }
 
 func New(opts Options) *State {
+	state := newState(opts)
+
+	// other processes on the same database will tell us what they did (we start listening before loading
+	// the groups so nothing is lost in between)
+	var changes chan Change
+	if state.changeBus != nil {
+		var err error
+		changes, err = state.changeBus.Subscribe(state.ctx)
+		if err != nil {
+			panic(fmt.Errorf("failed to subscribe to changes: %w", err))
+		}
+	}
+
+	// load all groups
+	err := state.loadGroupsFromDB(state.ctx)
+	if err != nil {
+		panic(fmt.Errorf("failed to load groups from db: %w", err))
+	}
+	if changes != nil {
+		state.background(func(ctx context.Context) { state.listenForChanges(ctx, changes) })
+	}
+
+	if opts.NoBackgroundWork {
+		return state
+	}
+
+	// delete events with an "expiration" tag once they expire
+	state.background(state.runExpirationScheduler)
+
+	// the search index from EnableSearch lives only in memory
+	if opts.SearchIndex == nil && state.SearchIndex != nil {
+		state.background(state.buildSearchIndex)
+	}
+
+	return state
+}
+
+// newState builds a State that has nothing loaded and does nothing in the background yet.
+func newState(opts Options) *State {
 	pubkey, _ := nostr.GetPublicKey(opts.SecretKey)
 
 	// events that just got deleted will be cached here for `tooOld` seconds such that someone doesn't rebroadcast
 	// them -- after that time we won't accept them anymore, so we can remove their ids from this cache
 	deletedCache := set.NewSliceSet[string]()
 
+	if opts.AuditLogSize == 0 {
+		opts.AuditLogSize = 10000
+	}
+
 	// we keep basic data about all groups in memory
 	groups := xsync.NewMapOf[string, *Group]()
 
@@ -56,19 +161,46 @@ func New(opts Options) *State {
 		DB:     opts.DB,
 
 		AllowPrivateGroups: true,
+		MaxFeedGroups:      100,
 
+		audit:                   &auditLog{maxEntries: opts.AuditLogSize},
+		memberships:             &membershipIndex{groups: make(map[string]map[string][]*nip29.Role)},
 		deletedCache:            deletedCache,
+		expiration:              &expirationScheduler{wake: make(chan struct{}, 1), limit: maxScheduledExpirations},
 		publicKey:               pubkey,
 		secretKey:               opts.SecretKey,
 		defaultRoles:            opts.DefaultRoles,
 		groupCreatorDefaultRole: opts.GroupCreatorDefaultRole,
+		fullMembersListLimit:    opts.FullMembersListLimit,
+		groupStore:              opts.GroupStore,
+		changeBus:               opts.ChangeBus,
+		instance:                randomInstanceId(),
 	}
 
-	// load all groups
-	err := state.loadGroupsFromDB(context.Background())
-	if err != nil {
-		panic(fmt.Errorf("failed to load groups from db: %w", err))
+	state.ctx, state.cancel = context.WithCancel(context.Background())
+	state.Pipeline = state.newPipeline()
+
+	if opts.SearchIndex != nil {
+		state.SearchIndex = opts.SearchIndex
+	} else if opts.EnableSearch {
+		state.SearchIndex = NewMemorySearchIndex()
 	}
 
 	return state
 }
+
+// background runs something until Close is called.
+func (s *State) background(fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.ctx)
+	}()
+}
+
+// Close stops everything the State is doing in the background (including following another relay) and waits for
+// it, after which the database can be closed.
+func (s *State) Close() {
+	s.cancel()
+	s.workers.Wait()
+}
@@ -0,0 +1,64 @@
+package relay29
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+	state.Follow(LocalReplicationSource{Leader: newTestState()})
+	state.Close()
+
+	// nothing happens in the background anymore
+	expired := &nostr.Event{
+		CreatedAt: nostr.Now() - 10,
+		Kind:      9,
+		Tags:      nostr.Tags{{"h", "g"}, {"expiration", strconv.FormatInt(int64(nostr.Now()-1), 10)}},
+	}
+	expired.Sign(nostr.GeneratePrivateKey())
+	require.NoError(t, state.DB.SaveEvent(ctx, expired))
+	state.ScheduleExpiration(ctx, expired)
+	time.Sleep(time.Millisecond * 100)
+
+	res, err := state.DB.QueryEvents(ctx, nostr.Filter{IDs: []string{expired.ID}})
+	require.NoError(t, err)
+	require.NotNil(t, <-res)
+}
+
+func TestNoBackgroundWork(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+	require.NoError(t, state.CreateGroup(ctx, "g", state.publicKey, EditMetadata{}))
+	state.Close()
+
+	expired := &nostr.Event{
+		CreatedAt: nostr.Now() - 10,
+		Kind:      9,
+		Tags:      nostr.Tags{{"h", "g"}, {"expiration", strconv.FormatInt(int64(nostr.Now()-1), 10)}},
+	}
+	expired.Sign(nostr.GeneratePrivateKey())
+	require.NoError(t, state.DB.SaveEvent(ctx, expired))
+
+	// a tool looking at the database doesn't change it
+	offline := New(Options{Domain: state.Domain, DB: state.DB, SecretKey: state.secretKey, NoBackgroundWork: true})
+	time.Sleep(time.Millisecond * 100)
+	offline.Close()
+	res, err := state.DB.QueryEvents(ctx, nostr.Filter{IDs: []string{expired.ID}})
+	require.NoError(t, err)
+	require.NotNil(t, <-res)
+
+	// the relay does
+	online := New(Options{Domain: state.Domain, DB: state.DB, SecretKey: state.secretKey})
+	defer online.Close()
+	require.Eventually(t, func() bool {
+		res, _ := state.DB.QueryEvents(ctx, nostr.Filter{IDs: []string{expired.ID}})
+		return <-res == nil
+	}, time.Second, time.Millisecond*10)
+}
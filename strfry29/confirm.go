@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// strfry stores the events we accept a little later and never tells us about it, so we apply them right away, in
+// the order we accepted them (which is the order strfry stores them), and check later that they were really stored.
+// the ones that weren't are undone, together with everything we did because of them (like adding the author of a
+// join request to the group).
+//
+// since strfry writes the events in the order they were accepted, once an event shows up all the ones accepted
+// before it that aren't there were dropped. if nothing else shows up we only give up on an event after a long time,
+// as strfry may just be slow.
+//
+// all of this happens in the same goroutine that accepts the events, so nothing new is applied while an event is
+// being undone and the ones accepted after it are all there to be applied again.
+
+const (
+	confirmInterval = time.Millisecond * 500
+	confirmTimeout  = time.Minute
+)
+
+type acceptedEvent struct {
+	event *nostr.Event
+	at    time.Time
+
+	// the events we stored ourselves while reacting to this one
+	sideEffects []*nostr.Event
+}
+
+type sideEffectsKey struct{}
+
+// recordSideEffects is a StoreEvent stage that takes note of the events stored while applying an accepted event.
+func recordSideEffects(ctx context.Context, event *nostr.Event) error {
+	if effects, ok := ctx.Value(sideEffectsKey{}).(*[]*nostr.Event); ok {
+		*effects = append(*effects, event)
+	}
+	return nil
+}
+
+// applyAccepted does what is done after an event is saved, so the next one already sees the changes it makes.
+func applyAccepted(state *relay29.State, event *nostr.Event) acceptedEvent {
+	acc := acceptedEvent{event: event, at: time.Now()}
+	state.Pipeline.AfterSave(context.WithValue(ctx, sideEffectsKey{}, &acc.sideEffects), event)
+	return acc
+}
+
+type confirmer struct {
+	state   *relay29.State
+	stored  func(ids []string) (map[string]bool, error)
+	waiting []acceptedEvent
+}
+
+func (c *confirmer) check(now time.Time) {
+	if len(c.waiting) == 0 {
+		return
+	}
+
+	ids := make([]string, len(c.waiting))
+	for i, acc := range c.waiting {
+		ids[i] = acc.event.ID
+	}
+	stored, err := c.stored(ids)
+	if err != nil {
+		log.Print("[strfry29] failed to check stored events: " + err.Error())
+		return
+	}
+
+	lastStored := -1
+	for i, acc := range c.waiting {
+		if stored[acc.event.ID] {
+			lastStored = i
+		}
+	}
+
+	still := make([]acceptedEvent, 0, len(c.waiting))
+	for i, acc := range c.waiting {
+		switch {
+		case stored[acc.event.ID]:
+		case i < lastStored || now.Sub(acc.at) > confirmTimeout:
+			log.Printf("[strfry29] event %s was accepted but never stored, undoing it", acc.event.ID)
+			c.undo(acc, c.waiting[i+1:])
+		default:
+			still = append(still, acc)
+		}
+	}
+	c.waiting = still
+}
+
+// undo takes back an accepted event and its side effects, the events accepted after it are applied again on top.
+func (c *confirmer) undo(acc acceptedEvent, later []acceptedEvent) {
+	reload := make([]string, 0, 1)
+	if relay29.ModerationEventKinds.Includes(acc.event.Kind) {
+		reload = append(reload, relay29.GetGroupIDFromEvent(acc.event))
+	} else {
+		// this deletes it from strfry too, which does nothing, but also from everywhere else
+		c.state.Pipeline.Delete(ctx, acc.event)
+	}
+
+	for _, evt := range acc.sideEffects {
+		if err := c.state.Pipeline.Delete(ctx, evt); err != nil {
+			log.Printf("[strfry29] failed to delete %s: %s", evt.ID, err)
+		}
+		if relay29.ModerationEventKinds.Includes(evt.Kind) {
+			reload = append(reload, relay29.GetGroupIDFromEvent(evt))
+		}
+	}
+
+	if len(reload) == 0 {
+		return
+	}
+	pending := make([]*nostr.Event, 0, len(later))
+	for _, acc := range later {
+		pending = append(pending, acc.event)
+		pending = append(pending, acc.sideEffects...)
+	}
+	slices.Sort(reload)
+	for _, groupId := range slices.Compact(reload) {
+		c.state.ReloadGroup(ctx, groupId, pending...)
+	}
+}
+
+func strfryStored(ids []string) (map[string]bool, error) {
+	ch, err := strfrydb.QueryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(ids))
+	for evt := range ch {
+		stored[evt.ID] = true
+	}
+	return stored, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/relay29"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/stretchr/testify/require"
+)
+
+type testRelay struct{ state *relay29.State }
+
+func (r testRelay) AddEvent(ctx context.Context, evt *nostr.Event) (skipBroadcast bool, writeError error) {
+	return false, r.state.DB.SaveEvent(ctx, evt)
+}
+
+func (r testRelay) BroadcastEvent(evt *nostr.Event) {}
+
+func TestUndoEventsNeverStored(t *testing.T) {
+	db := &relay29.MemoryStore{}
+	db.Init()
+	owner := &nip29.Role{Name: "owner"}
+	state = relay29.New(relay29.Options{
+		Domain:                  "localhost",
+		DB:                      db,
+		SecretKey:               nostr.GeneratePrivateKey(),
+		DefaultRoles:            []*nip29.Role{owner},
+		GroupCreatorDefaultRole: owner,
+	})
+	state.GetAuthed = func(context.Context) string { return "" }
+	state.AllowAction = func(ctx context.Context, group nip29.Group, role *nip29.Role, action relay29.Action) bool {
+		return role == owner
+	}
+	state.Relay = testRelay{state}
+	state.Pipeline.StoreEvent.Append("recordSideEffects", recordSideEffects)
+
+	creator := nostr.GeneratePrivateKey()
+	creatorPk, _ := nostr.GetPublicKey(creator)
+	require.NoError(t, state.CreateGroup(ctx, "g", creatorPk, relay29.EditMetadata{}))
+
+	// this is what strfry has stored
+	strfry := make(map[string]bool)
+	c := &confirmer{state: state, stored: func(ids []string) (map[string]bool, error) { return strfry, nil }}
+	now := nostr.Now()
+	publish := func(signer string, evt *nostr.Event) {
+		now++
+		evt.CreatedAt = now
+		evt.Sign(signer)
+		reject, msg := accept(evt)
+		require.False(t, reject, msg)
+		c.waiting = append(c.waiting, applyAccepted(state, evt))
+	}
+
+	// a join request gets the user in right away
+	joiner := nostr.GeneratePrivateKey()
+	joinerPk, _ := nostr.GetPublicKey(joiner)
+	joinRequest := &nostr.Event{Kind: nostr.KindSimpleGroupJoinRequest, Tags: nostr.Tags{{"h", "g"}}}
+	publish(joiner, joinRequest)
+	require.Contains(t, state.Memberships(joinerPk), "g")
+
+	// then a moderator adds someone else
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	putUser := &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", member}}}
+	publish(creator, putUser)
+	require.Contains(t, state.Memberships(member), "g")
+
+	// nothing is undone while strfry is just slow
+	c.check(time.Now())
+	require.Len(t, c.waiting, 2)
+	require.Contains(t, state.Memberships(joinerPk), "g")
+
+	// strfry stores the second but not the first, so the first was dropped, and the user it added goes away
+	strfry[putUser.ID] = true
+	require.NoError(t, db.SaveEvent(ctx, putUser))
+	c.check(time.Now())
+	require.Empty(t, c.waiting)
+	require.NotContains(t, state.Memberships(joinerPk), "g")
+	require.Contains(t, state.Memberships(member), "g")
+
+	// and the same if nothing shows up for a long time
+	other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	putOther := &nostr.Event{Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "g"}, {"p", other}}}
+	publish(creator, putOther)
+	require.Contains(t, state.Memberships(other), "g")
+	c.check(time.Now().Add(confirmTimeout + time.Second))
+	require.Empty(t, c.waiting)
+	require.NotContains(t, state.Memberships(other), "g")
+	require.Contains(t, state.Memberships(member), "g")
+}
@@ -42,6 +42,7 @@ func main() {
 		StrfryExecutable        string              `json:"strfry_executable_path"`
 		Permissions             map[string][]string `json:"permissions"`
 		GroupCreatorDefaultRole string              `json:"group_creator_default_role"`
+		AuditLogPath            string              `json:"audit_log_path"`
 	}
 	if err := json.Unmarshal(confb, &conf); err != nil {
 		log.Fatalf("invalid json config at %s: %s", path, err)
@@ -79,52 +80,92 @@ func main() {
 		return slices.Contains(conf.Permissions[roleName], action.Name())
 	}
 
+	// roles that can moderate are listed as admins
+	adminRoles := make(map[string]bool, len(conf.Permissions))
+	for name, actions := range conf.Permissions {
+		adminRoles[name] = slices.ContainsFunc(actions, func(action string) bool {
+			return action == "put-user" || action == "remove-user" || action == "edit-metadata" ||
+				action == "delete-event" || action == "delete-group"
+		})
+	}
+	state.IsAdminRole = func(group nip29.Group, role *nip29.Role) bool {
+		return adminRoles[role.Name]
+	}
+
 	state.AllowPrivateGroups = false
+	state.Adapter = "strfry29"
+
+	if conf.AuditLogPath != "" {
+		auditLog, err := os.OpenFile(conf.AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("failed to open audit log at %s: %s", conf.AuditLogPath, err)
+			return
+		}
+		defer auditLog.Close()
+		state.AuditLogWriter = auditLog
+	}
 	state.GetAuthed = func(ctx context.Context) string { return "" }
 	state.Relay = protoRelay{}
+	state.Pipeline.RejectEvent.InsertBefore("RequireHTagForExistingGroup", "rejectMetadataEvents", rejectMetadataEvents)
+	state.Pipeline.StoreEvent.Append("recordSideEffects", recordSideEffects)
 
 	// rebuild metadata events (replaceable) for all groups and make them available
-	filter := nostr.Filter{Kinds: []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers}}
+	filter := nostr.Filter{Kinds: nip29.MetadataEventKinds}
 	if err := republishMetadataEvents(filter); err != nil {
 		log.Fatalf("failed to republish metadata events on startup: %s", err)
 		return
 	}
 
-	for {
-		var msg StrfryMessage
-
-		err := incoming.Decode(&msg)
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			log.Print("[strfry29] failed to decode request. killing: " + err.Error())
-			return
+	messages := make(chan StrfryMessage)
+	go func() {
+		defer close(messages)
+		for {
+			var msg StrfryMessage
+
+			err := incoming.Decode(&msg)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Print("[strfry29] failed to decode request. killing: " + err.Error())
+				return
+			}
+
+			// message, _ := json.Marshal(msg)
+			// log.Print("[strfry29] got event: ", string(message))
+
+			messages <- msg
 		}
+	}()
+
+	c := &confirmer{state: state, stored: strfryStored}
+	ticker := time.NewTicker(confirmInterval)
+	defer ticker.Stop()
 
-		// message, _ := json.Marshal(msg)
-		// log.Print("[strfry29] got event: ", string(message))
-
-		if reject, rejectMsg := accept(msg.Event); reject {
-			outgoing.Encode(StrfryResponse{
-				ID:     msg.Event.ID,
-				Action: "reject",
-				Msg:    rejectMsg,
-			})
-		} else {
-			outgoing.Encode(StrfryResponse{
-				ID:     msg.Event.ID,
-				Action: "accept",
-			})
-
-			go func() {
-				time.Sleep(time.Millisecond * 200)
-
-				state.ApplyModerationAction(ctx, msg.Event)
-				state.ReactToJoinRequest(ctx, msg.Event)
-				state.ReactToLeaveRequest(ctx, msg.Event)
-				state.AddToPreviousChecking(ctx, msg.Event)
-			}()
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			if reject, rejectMsg := accept(msg.Event); reject {
+				outgoing.Encode(StrfryResponse{
+					ID:     msg.Event.ID,
+					Action: "reject",
+					Msg:    rejectMsg,
+				})
+			} else {
+				outgoing.Encode(StrfryResponse{
+					ID:     msg.Event.ID,
+					Action: "accept",
+				})
+
+				// the next event must already see the changes this one makes, see confirm.go
+				c.waiting = append(c.waiting, applyAccepted(state, msg.Event))
+			}
+		case now := <-ticker.C:
+			c.check(now)
 		}
 	}
 }
@@ -148,6 +189,10 @@ func (p protoRelay) AddEvent(ctx context.Context, evt *nostr.Event) (skipBroadca
 	return false, err
 }
 
+// strfry only sends to clients what it stores, but everything else was already stored by the pipeline, so only the
+// metadata events we generate have to go there.
 func (p protoRelay) BroadcastEvent(evt *nostr.Event) {
-	strfrydb.SaveEvent(ctx, evt)
+	if nip29.MetadataEventKinds.Includes(evt.Kind) || evt.Kind == relay29.KindSimpleGroupMembersDelta {
+		strfrydb.SaveEvent(ctx, evt)
+	}
 }
@@ -3,11 +3,10 @@ package relay29
 import (
 	"context"
 	"fmt"
-	"sync/atomic"
-	"time"
 
-	"github.com/bep/debounce"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/rs/zerolog/log"
 )
 
 var internalCallContextKey = struct{}{}
@@ -16,43 +15,201 @@ func IsInternalCall(ctx context.Context) bool {
 	return ctx.Value(internalCallContextKey) != nil
 }
 
-var (
-	// this is to ensure correct ordering of events when a lot of actions are called simultaneously
-	applyEventsSerial              = atomic.Int64{}
-	applyEventsSerialResetDebounce = debounce.New(time.Second * 15)
-)
-
+// applyEvents performs a change made of one or more moderation events atomically: all events are first validated
+// against a scratch copy of the groups they affect (and by our own RejectEvent stages, see internalChecks), then stored, and
+// only then applied to the groups in memory, passed to the OnEventSaved stages and broadcasted. if any of the first
+// steps fails nothing is changed.
+//
+// the OnEventSaved stages are called while no other moderation events can be applied, so they shouldn't wait for
+// that to happen.
 func (s *State) applyEvents(ctx context.Context, events ...*nostr.Event) error {
+	// other processes may have changed these groups (see cluster.go)
+	for _, evt := range events {
+		if gtag := evt.Tags.GetFirst([]string{"h", ""}); gtag != nil {
+			s.catchUp(ctx, (*gtag)[1])
+		}
+	}
+
+	// nobody else can touch the groups while we do this
+	s.moderationMu.Lock()
+	defer s.moderationMu.Unlock()
+
+	return s.applyEventsLocked(ctx, events...)
+}
+
+// internalChecks are the RejectEvent stages that apply to the events we generate ourselves, the custom ones that may
+// have been added to the pipeline (like rate limits) are meant for clients and the others skip these anyway.
+func (s *State) internalChecks() []func(context.Context, *nostr.Event) (bool, string) {
+	return []func(context.Context, *nostr.Event) (bool, string){
+		s.RejectWritesWhileFollowing,
+		s.RejectExpiredEvents,
+		s.PreventWritingOfEventsJustDeleted,
+		s.CheckPreviousTag,
+	}
+}
+
+// applyEventsLocked is applyEvents for when moderationMu is already held.
+func (s *State) applyEventsLocked(ctx context.Context, events ...*nostr.Event) error {
 	ourCtx := context.WithValue(ctx, internalCallContextKey, struct{}{})
 
+	// this ensures these events will be ordered correctly among themselves and with everything else
+	s.stampSequence(events)
+
 	for _, evt := range events {
-		// add this to our relay -- from there it will be picked by the pipeline
-		// we don't even have to sign it
 		evt.Tags = append(evt.Tags, nostr.Tag{"autogenerated"})
-		evt.CreatedAt += nostr.Timestamp(applyEventsSerial.Add(1))
-		if evt.PubKey == "" {
-			// we default to using the relay internal key here, but could have been someone else's
-			evt.PubKey = s.publicKey
+		if evt.PubKey == "" || evt.PubKey == s.publicKey {
+			// we default to using the relay internal key here
+			if err := evt.Sign(s.secretKey); err != nil {
+				return fmt.Errorf("failed to sign event: %w", err)
+			}
+		} else {
+			// but could have been someone else's, in which case we don't even have to sign it
+			evt.ID = evt.GetID()
+		}
+	}
+
+	// validate everything before touching anything
+	actions, err := s.validateBatch(ourCtx, events)
+	if err != nil {
+		return err
+	}
+	for _, evt := range events {
+		for _, check := range s.internalChecks() {
+			if reject, msg := check(ourCtx, evt); reject {
+				return fmt.Errorf("event %s was rejected: %s", evt, msg)
+			}
+		}
+	}
+
+	// store everything, undoing the writes that had already happened if one fails
+	for i, evt := range events {
+		if err := s.Pipeline.Store(ourCtx, evt); err != nil {
+			for _, stored := range events[0:i] {
+				if err := s.Pipeline.Delete(ourCtx, stored); err != nil {
+					log.Error().Err(err).Stringer("event", stored).Msg("failed to roll back event from failed batch")
+				}
+			}
+			return fmt.Errorf("failed to store event %s: %w", evt, err)
 		}
-		evt.ID = evt.GetID()
+	}
 
-		// we won't sign this event
-		if _, err := s.Relay.AddEvent(ourCtx, evt); err != nil {
-			return fmt.Errorf("failed to apply event %s: %w", evt, err)
+	// now apply to the actual groups -- this can't fail since it worked on the scratch copies
+	changed := make(map[*Group][]int, 1)
+	sequences := make(map[*Group]int64, 1)
+	for i, evt := range events {
+		var before int64
+		if group := s.GetGroupFromEvent(evt); group != nil {
+			before = group.sequence
+		}
+		s.recordModerationAttempt(evt, true, "", "")
+		group, kinds := s.applyModerationAction(ourCtx, evt, actions[i], sequenceTag(evt, evt.PubKey)) // we just put it there
+		if _, ok := sequences[group]; !ok {
+			sequences[group] = before
 		}
+		changed[group] = append(changed[group], kinds...)
+	}
+	for group, before := range sequences {
+		if s.claimSequence(ourCtx, group.Address.ID, before, group.sequence) {
+			// the group was rebuilt and everything was already broadcasted
+			delete(changed, group)
+		}
+	}
+	for _, evt := range events {
+		s.Pipeline.AfterSave(ourCtx, evt)
 	}
 
-	applyEventsSerialResetDebounce(func() { applyEventsSerial.Store(0) })
+	// and finally tell everybody
+	for _, evt := range events {
+		s.Relay.BroadcastEvent(evt)
+	}
+	for group, kinds := range changed {
+		s.broadcastMetadata(group, kinds...)
+	}
 
 	return nil
 }
 
+// validateBatch checks that the given moderation events can be applied in sequence and returns their actions.
+func (s *State) validateBatch(ctx context.Context, events []*nostr.Event) ([]Action, error) {
+	scratch := make(map[string]*nip29.Group, 1)
+	actions := make([]Action, len(events))
+
+	for i, evt := range events {
+		gtag := evt.Tags.GetFirst([]string{"h", ""})
+		if gtag == nil {
+			return nil, fmt.Errorf("event %s is missing a group (`h`) tag", evt)
+		}
+		groupId := (*gtag)[1]
+
+		group, seen := scratch[groupId]
+		if !seen {
+			if live, _ := s.Groups.Load(groupId); live != nil {
+				live.mu.RLock()
+				clone := cloneGroup(live.Group)
+				live.mu.RUnlock()
+				group = &clone
+			}
+		}
+
+		if evt.Kind == nostr.KindSimpleGroupCreateGroup {
+			if group != nil {
+				return nil, fmt.Errorf("group '%s' already exists", groupId)
+			}
+			group = &s.NewGroup(groupId, evt.PubKey).Group
+		} else if group == nil {
+			return nil, fmt.Errorf("group '%s' doesn't exist", groupId)
+		}
+		scratch[groupId] = group
+
+		action, err := s.prepareModerationAction(evt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid moderation event %s: %w", evt, err)
+		}
+		if evt.Kind == KindSimpleGroupRevert {
+			_, revert, err := s.prepareRevert(ctx, evt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid revert %s: %w", evt, err)
+			}
+			action = revert
+		}
+
+		action.Apply(group)
+		actions[i] = action
+
+		if evt.Kind == nostr.KindSimpleGroupDeleteGroup {
+			// nothing else can happen to this group after it's gone
+			scratch[groupId] = nil
+		}
+	}
+
+	return actions, nil
+}
+
 func (s *State) CreateGroup(ctx context.Context, groupId string, creator string, defs EditMetadata) error {
 	group, _ := s.Groups.Load(groupId)
 	if group != nil {
 		return fmt.Errorf("group '%s' already exists", groupId)
 	}
 
+	events := createGroupEvents(groupId, creator, defs)
+	if len(events[1].Tags) > 1 {
+		return s.applyEvents(ctx, events...)
+	}
+
+	// an edit-metadata event without any metadata doesn't change anything, so it is only sent out, not stored
+	if err := s.applyEvents(ctx, events[0]); err != nil {
+		return err
+	}
+	empty := events[1]
+	empty.Tags = append(empty.Tags, nostr.Tag{"autogenerated"})
+	if err := empty.Sign(s.secretKey); err != nil {
+		return fmt.Errorf("failed to sign event: %w", err)
+	}
+	s.Relay.BroadcastEvent(empty)
+	return nil
+}
+
+func createGroupEvents(groupId string, creator string, defs EditMetadata) []*nostr.Event {
 	metadataTags := make([]nostr.Tag, 1, 7)
 
 	metadataTags[0] = nostr.Tag{"h", groupId}
@@ -79,9 +236,20 @@ func (s *State) CreateGroup(ctx context.Context, groupId string, creator string,
 			metadataTags = append(metadataTags, nostr.Tag{"public"})
 		}
 	}
+	if defs.TopicsValue != nil {
+		if len(*defs.TopicsValue) == 0 {
+			metadataTags = append(metadataTags, nostr.Tag{"t", ""})
+		}
+		for _, topic := range *defs.TopicsValue {
+			metadataTags = append(metadataTags, nostr.Tag{"t", topic})
+		}
+	}
+	if defs.LanguageValue != nil {
+		metadataTags = append(metadataTags, nostr.Tag{"l", *defs.LanguageValue, "ISO-639-1"})
+	}
 
-	return s.applyEvents(ctx,
-		&nostr.Event{
+	return []*nostr.Event{
+		{
 			CreatedAt: nostr.Now(),
 			Kind:      nostr.KindSimpleGroupCreateGroup,
 			Tags: nostr.Tags{
@@ -89,12 +257,12 @@ func (s *State) CreateGroup(ctx context.Context, groupId string, creator string,
 			},
 			PubKey: creator, // this ensures the group creator gets assigned ownership
 		},
-		&nostr.Event{
+		{
 			CreatedAt: nostr.Now(),
 			Kind:      nostr.KindSimpleGroupEditMetadata,
 			Tags:      metadataTags,
 		},
-	)
+	}
 }
 
 func (s *State) PutUser(ctx context.Context, groupId string, pubkey string, roles ...string) error {
@@ -122,6 +290,16 @@ func (s *State) RemoveUserFromGroup(ctx context.Context, groupId string, pubkey
 	})
 }
 
+func (s *State) DeleteGroup(ctx context.Context, groupId string) error {
+	return s.applyEvents(ctx, &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindSimpleGroupDeleteGroup,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", groupId},
+		},
+	})
+}
+
 func (s *State) DeleteEvent(ctx context.Context, groupId string, eventId string) error {
 	return s.applyEvents(ctx, &nostr.Event{
 		CreatedAt: nostr.Now(),
@@ -132,3 +310,88 @@ func (s *State) DeleteEvent(ctx context.Context, groupId string, eventId string)
 		},
 	})
 }
+
+// PageEvents goes through all the events that match a filter, newest first, a page at a time, so it works with
+// databases and relays that cap the number of results. each page starts at the second the previous one ended in, so
+// nothing is lost when many events share it, and fn is only called once for each event.
+func PageEvents(
+	ctx context.Context,
+	query func(context.Context, nostr.Filter) (chan *nostr.Event, error),
+	filter nostr.Filter,
+	fn func(*nostr.Event),
+) error {
+	const pageSize = 500
+	limit := pageSize
+
+	// only the events in the second where the last page ended can show up again
+	var boundary nostr.Timestamp
+	seen := make(map[string]struct{})
+
+	for {
+		filter.Limit = limit
+		ch, err := query(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		count, fresh := 0, 0
+		var oldest nostr.Timestamp
+		atOldest := make(map[string]struct{})
+		for evt := range ch {
+			count++
+			if count == 1 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+				clear(atOldest)
+			}
+			if evt.CreatedAt == oldest {
+				atOldest[evt.ID] = struct{}{}
+			}
+			if _, ok := seen[evt.ID]; ok {
+				continue
+			}
+			fresh++
+			fn(evt)
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if count < limit && limit == pageSize {
+			// fewer than we asked for, so there's nothing else. with a bigger limit this doesn't tell us anything, the
+			// database may just not return that many at once (which we only know when it sends the same events again)
+			return nil
+		}
+
+		if fresh > 0 {
+			// go on from the same second
+			if oldest != boundary {
+				boundary = oldest
+				seen = atOldest
+			} else {
+				for id := range atOldest {
+					seen[id] = struct{}{}
+				}
+			}
+			limit = pageSize
+			filter.Until = &boundary
+			continue
+		}
+
+		// a whole page in a second we had already seen
+		if count == limit {
+			// there may be more in it, get a bigger page
+			limit *= 2
+			continue
+		}
+
+		// the database won't give us more than this at once, so whatever else is in this second is lost
+		log.Warn().Int("max", count).Int64("second", int64(boundary)).
+			Msg("too many events in the same second, some may have been skipped")
+		if boundary == 0 || (filter.Since != nil && boundary <= *filter.Since) {
+			return nil
+		}
+		until := boundary - 1
+		filter.Until = &until
+		limit = pageSize
+	}
+}
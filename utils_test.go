@@ -0,0 +1,122 @@
+package relay29
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStore fails to save the nth event it gets
+type flakyStore struct {
+	eventstore.Store
+	failAt int
+	saved  int
+}
+
+func (f *flakyStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	f.saved++
+	if f.saved == f.failAt {
+		return fmt.Errorf("disk is full")
+	}
+	return f.Store.SaveEvent(ctx, evt)
+}
+
+func TestApplyEventsIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	creator, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	name := "atomic"
+
+	countStored := func() int {
+		ch, err := state.DB.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"h": []string{"z"}}})
+		require.NoError(t, err)
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+
+	// an invalid event in the batch prevents everything from happening
+	err := state.applyEvents(ctx,
+		&nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "z"}}},
+		&nostr.Event{CreatedAt: nostr.Now(), Kind: nostr.KindSimpleGroupPutUser, Tags: nostr.Tags{{"h", "z"}, {"p", "nothex"}}},
+	)
+	require.Error(t, err)
+	_, exists := state.Groups.Load("z")
+	require.False(t, exists, "group shouldn't have been created")
+	require.Equal(t, 0, countStored())
+
+	// a failure while storing rolls back what was stored before
+	state.DB = &flakyStore{Store: state.DB, failAt: 2}
+	require.Error(t, state.CreateGroup(ctx, "z", creator, EditMetadata{NameValue: &name}))
+	_, exists = state.Groups.Load("z")
+	require.False(t, exists, "group shouldn't have been created")
+	require.Equal(t, 0, countStored())
+
+	// when everything works everything is applied
+	require.NoError(t, state.CreateGroup(ctx, "z", creator, EditMetadata{NameValue: &name}))
+	group, _ := state.Groups.Load("z")
+	require.Equal(t, "atomic", group.Name)
+	require.Contains(t, group.Members, creator)
+	require.Equal(t, 2, countStored())
+}
+
+func TestPageEvents(t *testing.T) {
+	ctx := context.Background()
+	db := &slicestore.SliceStore{MaxLimit: 5000}
+	db.Init()
+
+	// lots of events in the same second, with some before and after
+	sk := nostr.GeneratePrivateKey()
+	store := func(createdAt nostr.Timestamp, n int) {
+		for i := 0; i < n; i++ {
+			evt := &nostr.Event{CreatedAt: createdAt, Kind: 9, Content: fmt.Sprintf("%d %d", createdAt, i), Tags: nostr.Tags{{"h", "g"}}}
+			evt.Sign(sk)
+			require.NoError(t, db.SaveEvent(ctx, evt))
+		}
+	}
+	store(100, 1300)
+	store(50, 10)
+	store(150, 499)
+
+	seen := make(map[string]int)
+	err := PageEvents(ctx, db.QueryEvents, nostr.Filter{Kinds: []int{9}}, func(evt *nostr.Event) { seen[evt.ID]++ })
+	require.NoError(t, err)
+	require.Len(t, seen, 1809)
+	for _, count := range seen {
+		require.Equal(t, 1, count)
+	}
+
+	// when the database won't return all of them we still get to the ones before
+	db.MaxLimit = 500
+	clear(seen)
+	err = PageEvents(ctx, db.QueryEvents, nostr.Filter{Kinds: []int{9}}, func(evt *nostr.Event) { seen[evt.ID]++ })
+	require.NoError(t, err)
+	older := 0
+	until := nostr.Timestamp(50)
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Until: &until})
+	require.NoError(t, err)
+	for evt := range ch {
+		require.Equal(t, 1, seen[evt.ID])
+		older++
+	}
+	require.Equal(t, 10, older)
+
+	// even when the most it returns isn't one of the limits we ask for
+	db.MaxLimit = 700
+	clear(seen)
+	err = PageEvents(ctx, db.QueryEvents, nostr.Filter{Kinds: []int{9}}, func(evt *nostr.Event) { seen[evt.ID]++ })
+	require.NoError(t, err)
+	ch, err = db.QueryEvents(ctx, nostr.Filter{Until: &until})
+	require.NoError(t, err)
+	for evt := range ch {
+		require.Equal(t, 1, seen[evt.ID])
+	}
+}
@@ -0,0 +1,92 @@
+package relay29
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the metadata events we generate carry a "version" tag, which is the sequence number of the last moderation
+// event applied to the group, and a "hash" tag, which is a hash of everything in the group state (metadata,
+// topics and language, roles and members with their roles). clients can use these to tell if what they have
+// cached is stale.
+
+func (group *Group) ToMetadataEvent() *nostr.Event {
+	evt := group.Group.ToMetadataEvent()
+	for _, topic := range group.Topics {
+		evt.Tags = append(evt.Tags, nostr.Tag{"t", topic})
+	}
+	if group.Language != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"l", group.Language, "ISO-639-1"})
+	}
+	if group.MovedTo.Relay != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"moved", group.MovedTo.Relay, group.MovedTo.ID})
+	}
+	group.addVersionTags(evt)
+	return evt
+}
+
+func (group *Group) ToMembersEvent() *nostr.Event {
+	evt := group.Group.ToMembersEvent()
+	group.addVersionTags(evt)
+	return evt
+}
+
+func (group *Group) ToRolesEvent() *nostr.Event {
+	evt := group.Group.ToRolesEvent()
+	group.addVersionTags(evt)
+	return evt
+}
+
+// addVersionTags must be called with the group lock held (for reading, at least).
+func (group *Group) addVersionTags(evt *nostr.Event) {
+	evt.Tags = append(evt.Tags,
+		nostr.Tag{"version", strconv.FormatInt(group.sequence, 10)},
+		nostr.Tag{"hash", group.stateHash()},
+	)
+}
+
+// stateHash must be called with the group lock held (for reading, at least).
+func (group *Group) stateHash() string {
+	if hash := group.hash.Load(); hash != nil {
+		return *hash
+	}
+
+	h := sha256.New()
+	write := func(fields ...string) {
+		for _, field := range fields {
+			h.Write([]byte(strconv.Itoa(len(field))))
+			h.Write([]byte{':'})
+			h.Write([]byte(field))
+		}
+	}
+
+	write(group.Address.ID, group.Name, group.About, group.Picture,
+		strconv.FormatBool(group.Private), strconv.FormatBool(group.Closed))
+
+	write("topics")
+	write(group.Topics...)
+	write("language", group.Language)
+	write("moved", group.MovedTo.Relay, group.MovedTo.ID)
+
+	write("roles")
+	for _, role := range group.Roles {
+		write(role.Name, role.Description)
+	}
+
+	write("members")
+	members := make([]string, 0, len(group.Members))
+	for pubkey, roles := range group.Members {
+		members = append(members, pubkey+":"+strings.Join(RoleNames(roles), ","))
+	}
+	slices.Sort(members)
+	write(members...)
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	group.hash.Store(&hash)
+	return hash
+}
@@ -0,0 +1,45 @@
+package relay29
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionTags(t *testing.T) {
+	ctx := context.Background()
+	state := newTestState()
+
+	owner, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	member, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	require.NoError(t, state.CreateGroup(ctx, "v", owner, EditMetadata{}))
+
+	group, _ := state.Groups.Load("v")
+	tags := func() (string, string) {
+		evt := group.ToMembersEvent()
+		return evt.Tags.GetFirst([]string{"version", ""}).Value(), evt.Tags.GetFirst([]string{"hash", ""}).Value()
+	}
+
+	version1, hash1 := tags()
+	require.Equal(t, "1", version1)
+
+	// changes to the group change both
+	require.NoError(t, state.PutUser(ctx, "v", member))
+	version2, hash2 := tags()
+	require.Equal(t, "2", version2)
+	require.NotEqual(t, hash1, hash2)
+
+	// undoing a change gets us the same hash again, but never the same version
+	require.NoError(t, state.RemoveUserFromGroup(ctx, "v", member))
+	version3, hash3 := tags()
+	require.Equal(t, "3", version3)
+	require.Equal(t, hash1, hash3)
+
+	// all the lists carry the same tags
+	for _, evt := range []*nostr.Event{group.ToMetadataEvent(), group.ToAdminsEvent(), group.ToRolesEvent()} {
+		require.Equal(t, version3, evt.Tags.GetFirst([]string{"version", ""}).Value())
+		require.Equal(t, hash3, evt.Tags.GetFirst([]string{"hash", ""}).Value())
+	}
+}